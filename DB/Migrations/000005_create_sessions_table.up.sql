@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS sessions (
+  id bigserial PRIMARY KEY,
+  user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  refresh_token_hash bytea UNIQUE NOT NULL,
+  expiry timestamp(0) with time zone NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
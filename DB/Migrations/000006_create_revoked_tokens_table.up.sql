@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+  jti text PRIMARY KEY,
+  expiry timestamp(0) with time zone NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
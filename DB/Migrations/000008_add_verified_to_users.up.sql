@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified boolean NOT NULL DEFAULT false;
+
+-- Users that registered before verification existed are trusted
+UPDATE users SET verified = true;
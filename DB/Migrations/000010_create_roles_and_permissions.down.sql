@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS admin_users (
+  id bigserial PRIMARY KEY, 
+  user_id int REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO admin_users (user_id)
+SELECT user_roles.user_id FROM user_roles
+JOIN roles ON roles.id = user_roles.role_id
+WHERE roles.name = 'admin';
+
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,48 @@
+CREATE TABLE IF NOT EXISTS roles (
+  id bigserial PRIMARY KEY,
+  name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+  id bigserial PRIMARY KEY,
+  code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role_id int NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+  permission_id int NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+
+  PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role_id int NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+
+  PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (code) VALUES
+  ('categories:read'),
+  ('categories:write'),
+  ('users:read'),
+  ('users:write'),
+  ('user-categories:assign');
+
+INSERT INTO roles (name) VALUES ('admin'), ('support');
+
+-- Admins can do everything, support staff can only look
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin';
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'support' AND permissions.code IN ('categories:read', 'users:read');
+
+-- Existing admins keep their rights
+INSERT INTO user_roles (user_id, role_id)
+SELECT DISTINCT admin_users.user_id, roles.id FROM admin_users, roles
+WHERE roles.name = 'admin' AND admin_users.user_id IS NOT NULL;
+
+DROP TABLE IF EXISTS admin_users;
@@ -0,0 +1 @@
+DELETE FROM permissions WHERE code = 'roles:write';
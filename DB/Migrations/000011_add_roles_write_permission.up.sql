@@ -0,0 +1,5 @@
+INSERT INTO permissions (code) VALUES ('roles:write');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'roles:write';
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  id bigserial PRIMARY KEY,
+  user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name text NOT NULL,
+  hash bytea UNIQUE NOT NULL,
+  scopes text[] NOT NULL DEFAULT '{}',
+  expiry timestamp(0) with time zone NOT NULL,
+  last_used timestamp(0) with time zone,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+
+  UNIQUE (user_id, name)
+);
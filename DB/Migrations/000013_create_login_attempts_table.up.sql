@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+  id bigserial PRIMARY KEY,
+  user_id int REFERENCES users(id) ON DELETE SET NULL,
+  email citext NOT NULL,
+  ip text NOT NULL,
+  success boolean NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_ip_created_idx ON login_attempts (ip, created);
+CREATE INDEX IF NOT EXISTS login_attempts_email_created_idx ON login_attempts (email, created);
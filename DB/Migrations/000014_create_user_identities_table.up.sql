@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+  id bigserial PRIMARY KEY,
+  user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider text NOT NULL,
+  subject text NOT NULL,
+  email citext NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+
+  UNIQUE (provider, subject)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+  state_hash bytea PRIMARY KEY,
+  provider text NOT NULL,
+  code_verifier text NOT NULL,
+  nonce text NOT NULL,
+  expiry timestamp(0) with time zone NOT NULL
+);
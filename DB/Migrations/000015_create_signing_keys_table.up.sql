@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS signing_keys (
+  id text PRIMARY KEY,
+  algorithm text NOT NULL,
+  private_key bytea NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  retired timestamp(0) with time zone,
+  expiry timestamp(0) with time zone
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS audit_log;
+
+DELETE FROM permissions WHERE code = 'users:impersonate';
@@ -0,0 +1,23 @@
+DELETE FROM permissions WHERE code = 'users:impersonate';
+INSERT INTO permissions (code) VALUES ('users:impersonate');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'users:impersonate';
+
+-- No foreign keys so the trail outlives the users in it
+CREATE TABLE IF NOT EXISTS audit_log (
+  id bigserial PRIMARY KEY,
+  actor_id int NOT NULL,
+  actor_name text NOT NULL,
+  user_id int NOT NULL,
+  user_name text NOT NULL,
+  action text NOT NULL,
+  method text NOT NULL,
+  path text NOT NULL,
+  status int NOT NULL,
+  ip text NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_idx ON audit_log (created);
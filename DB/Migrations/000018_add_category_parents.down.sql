@@ -0,0 +1,5 @@
+ALTER TABLE user_categories DROP COLUMN IF EXISTS include_descendants;
+
+DROP INDEX IF EXISTS categories_parent_id_idx;
+ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_parent_not_self;
+ALTER TABLE categories DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,8 @@
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS parent_id bigint REFERENCES categories(id) ON DELETE SET NULL;
+ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_parent_not_self;
+ALTER TABLE categories ADD CONSTRAINT categories_parent_not_self CHECK (parent_id <> id);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+
+-- Activations with include_descendants make every category under the activated one visible too
+ALTER TABLE user_categories ADD COLUMN IF NOT EXISTS include_descendants boolean NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS categories_slug_key;
+
+ALTER TABLE categories DROP COLUMN IF EXISTS archived;
+ALTER TABLE categories DROP COLUMN IF EXISTS display_order;
+ALTER TABLE categories DROP COLUMN IF EXISTS slug;
+ALTER TABLE categories DROP COLUMN IF EXISTS icon;
+ALTER TABLE categories DROP COLUMN IF EXISTS description;
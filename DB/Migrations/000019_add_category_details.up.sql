@@ -0,0 +1,8 @@
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS icon text NOT NULL DEFAULT '';
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS slug text;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS display_order int NOT NULL DEFAULT 0;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS archived boolean NOT NULL DEFAULT false;
+
+-- Slugs are optional, NULLs don't clash with each other
+CREATE UNIQUE INDEX IF NOT EXISTS categories_slug_key ON categories (slug);
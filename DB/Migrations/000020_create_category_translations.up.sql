@@ -0,0 +1,11 @@
+-- Names and descriptions of categories in other locales than the default one,
+-- the default locale is what's in the categories table itself
+CREATE TABLE IF NOT EXISTS category_translations (
+  category_id bigint NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+  locale text NOT NULL,
+  name text NOT NULL,
+  description text NOT NULL DEFAULT '',
+
+  PRIMARY KEY (category_id, locale),
+  CONSTRAINT category_translations_locale_name_key UNIQUE (locale, name)
+);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS group_categories;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
+
+DELETE FROM permissions WHERE code = 'groups:write';
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS groups (
+  id bigserial PRIMARY KEY,
+  name text UNIQUE NOT NULL,
+  created timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+  group_id bigint NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+  user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+
+  PRIMARY KEY (group_id, user_id)
+);
+
+-- Visibility is looked up by user
+CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members (user_id);
+
+-- Categories activated for every member of the group, like user_categories
+CREATE TABLE IF NOT EXISTS group_categories (
+  group_id bigint NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+  category_id bigint NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+  include_descendants boolean NOT NULL DEFAULT false,
+
+  PRIMARY KEY (group_id, category_id)
+);
+
+DELETE FROM permissions WHERE code = 'groups:write';
+INSERT INTO permissions (code) VALUES ('groups:write');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'groups:write';
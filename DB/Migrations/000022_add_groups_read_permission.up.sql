@@ -0,0 +1,7 @@
+DELETE FROM permissions WHERE code = 'groups:read';
+INSERT INTO permissions (code) VALUES ('groups:read');
+
+-- Support staff can look at groups like they can look at users
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name IN ('admin', 'support') AND permissions.code = 'groups:read';
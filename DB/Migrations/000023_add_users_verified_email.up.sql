@@ -0,0 +1,5 @@
+-- The email that was verified, verified alone doesn't say which one
+-- once the email can be changed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_email citext;
+
+UPDATE users SET verified_email = email WHERE verified;
@@ -0,0 +1,4 @@
+-- Encrypted keys can't be read without the column, the server creates a new key on startup
+DELETE FROM signing_keys WHERE encrypted;
+
+ALTER TABLE signing_keys DROP COLUMN IF EXISTS encrypted;
@@ -0,0 +1,2 @@
+-- Keys stored before their encryption are encrypted by the server the next time it loads them
+ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS encrypted boolean NOT NULL DEFAULT false;
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"Sadeem-RestAPI/internal/auth"
 	"Sadeem-RestAPI/internal/models"
 	"Sadeem-RestAPI/internal/server"
 	"Sadeem-RestAPI/internal/translation"
@@ -33,10 +34,6 @@ func main() {
 		panic("could not connect to database")
 	}
 
-	// Making sure the JWT signing key is available
-	if os.Getenv("JWT_SIGNING_KEY") == "" {
-		panic("No signking key found! please export the JWT_SIGNING_KEY env variable")
-	}
 	server := server.NewServer()
 
 	models.Models = &models.ModelStruct{
@@ -46,6 +43,39 @@ func main() {
 		Catagory: &models.CatagoryModel{
 			DB: pool,
 		},
+		Session: &models.SessionModel{
+			DB: pool,
+		},
+		Revoked: &models.RevocationModel{
+			DB: pool,
+		},
+		Token: &models.TokenModel{
+			DB: pool,
+		},
+		Role: &models.RoleModel{
+			DB: pool,
+		},
+		ApiKey: &models.ApiKeyModel{
+			DB: pool,
+		},
+		Identity: &models.IdentityModel{
+			DB: pool,
+		},
+		SigningKey: &models.SigningKeyModel{
+			DB: pool,
+		},
+		Audit: &models.AuditModel{
+			DB: pool,
+		},
+		Group: &models.GroupModel{
+			DB: pool,
+		},
+	}
+
+	// Making sure the JWT signing keys can be loaded
+	err = auth.LoadKeys()
+	if err != nil {
+		panic("could not load the JWT signing keys: " + err.Error())
 	}
 
 	print("starting server at http://localhost", server.Addr)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"Sadeem-RestAPI/internal/auth"
+	"Sadeem-RestAPI/internal/models"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const usage = `Manages the keys the API signs JWTs with
+
+Usage:
+  keys list
+        lists the keys that can still verify tokens
+  keys rotate [-grace 24h] [-algorithm RS256|EdDSA]
+        signs new tokens with a new key, the current key keeps
+        verifying tokens for the grace period
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		fail("No database URL found! please export the DATABASE_URL env variable")
+	}
+
+	pool, err := pgxpool.New(context.Background(), databaseURL)
+	if err != nil {
+		fail("could not connect to database")
+	}
+	defer pool.Close()
+
+	models.Models = &models.ModelStruct{
+		SigningKey: &models.SigningKeyModel{
+			DB: pool,
+		},
+	}
+
+	switch os.Args[1] {
+	case "list":
+		list()
+	case "rotate":
+		rotate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func list() {
+	keys, err := models.Models.SigningKey.GetActive()
+	if err != nil {
+		fail(err.Error())
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALGORITHM\tCREATED\tSTATUS")
+	for _, key := range keys {
+		status := "signing"
+		if key.Retired != nil {
+			status = "verifying until " + key.Expiry.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, key.Created.Format(time.RFC3339), status)
+	}
+	w.Flush()
+}
+
+func rotate(args []string) {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	grace := flags.Duration("grace", 24*time.Hour, "how long the replaced keys keep verifying tokens")
+	algorithm := flags.String("algorithm", auth.SigningAlgorithm, "RS256 or EdDSA")
+	flags.Parse(args)
+
+	// Anything shorter than an access token's lifetime would log people out
+	if *grace < auth.AccessTokenTTL {
+		fail(fmt.Sprintf("the grace period can't be shorter than the access token lifetime (%s)", auth.AccessTokenTTL))
+	}
+
+	key, err := auth.GenerateSigningKey(*algorithm)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	err = models.Models.SigningKey.Rotate(key, *grace)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	fmt.Printf("new %s key %s is signing tokens, the old keys expire in %s\n", key.Algorithm, key.ID, *grace)
+}
+
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(1)
+}
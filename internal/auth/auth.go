@@ -2,32 +2,248 @@ package auth
 
 import (
 	"Sadeem-RestAPI/internal/models"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	// Access tokens are short lived, clients use their refresh token to get new ones
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	// Challenge tokens are handed out after the password check
+	// and exchanged for real tokens with a TOTP code
+	ChallengeTokenTTL = 5 * time.Minute
+	challengeAudience = "2fa-challenge"
+
+	// Impersonation tokens can't be refreshed, the admin asks for a new one
+	ImpersonationTokenTTL = 10 * time.Minute
+)
+
+// When set admins and other staff only get their roles' permissions after they enable 2FA
+var RequireAdmin2FA = os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+
+var ErrInvalidChallenge = errors.New("invalid challenge token")
+
 type JwtClaims struct {
-	Name   string `json:"name"`
-	UserID int    `json:"id"`
-	Admin  bool   `json:"admin"`
+	Name      string   `json:"name"`
+	UserID    int      `json:"id"`
+	Admin     bool     `json:"admin"`
+	Scopes    []string `json:"scopes"`
+	SessionID int64    `json:"sid"`
+
+	// Set on impersonation tokens, the staff member acting as the user
+	Impersonator *Impersonator `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func CreateJwtToken(user *models.User) (string, error) {
-	signingKey := os.Getenv("JWT_SIGNING_KEY")
+// The act claim from RFC 8693
+type Impersonator struct {
+	Subject string `json:"sub"`
+	Name    string `json:"name"`
+}
+
+// What we hand back to the client after a login or a refresh
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+
+	// Set for admins and staff that have to enable 2FA before getting their permissions
+	TwoFactorSetupRequired bool `json:"twoFactorSetupRequired,omitempty"`
+}
+
+// Every token gets a random ID so it can be revoked on its own
+func newTokenID() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randomBytes), nil
+}
+
+func CreateJwtToken(user *models.User, sessionID int64) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := &JwtClaims{
 		user.UserName,
 		user.ID,
-		user.IsAdmin,
+		HasAdminRights(user),
+		GrantedScopes(user),
+		sessionID,
+		nil,
 		jwt.RegisteredClaims{
-			ID:        "user_token",
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 72)),
+			ID:        tokenID,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
 		},
 	}
 
-	rawToken := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	return signToken(claims)
+}
+
+// Creates a short lived token that lets a staff member see the API as the user does,
+// it's bound to the staff member's session so it dies when they logout
+func CreateImpersonationToken(user *models.User, actorID int, actorName string, sessionID int64) (string, time.Time, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(ImpersonationTokenTTL)
+	claims := &JwtClaims{
+		user.UserName,
+		user.ID,
+		HasAdminRights(user),
+		GrantedScopes(user),
+		sessionID,
+		&Impersonator{
+			Subject: strconv.Itoa(actorID),
+			Name:    actorName,
+		},
+		jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiry),
+		},
+	}
+
+	token, err := signToken(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiry, nil
+}
+
+// Users with roles but without 2FA are treated as regular users when 2FA is required for admins
+func needsTwoFactorSetup(user *models.User) bool {
+	return RequireAdmin2FA && !user.TOTPEnabled && len(user.Roles) > 0
+}
+
+func HasAdminRights(user *models.User) bool {
+	if needsTwoFactorSetup(user) {
+		return false
+	}
+
+	return user.IsAdmin
+}
+
+// The permissions that go into the token as scopes
+func GrantedScopes(user *models.User) []string {
+	if needsTwoFactorSetup(user) {
+		return []string{}
+	}
+
+	return user.Permissions
+}
+
+// Creates the token a user with 2FA gets after entering the right password,
+// it can't be used for anything other than finishing the login
+func CreateChallengeToken(user *models.User) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &jwt.RegisteredClaims{
+		ID:        tokenID,
+		Subject:   strconv.Itoa(user.ID),
+		Audience:  jwt.ClaimStrings{challengeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ChallengeTokenTTL)),
+	}
+
+	return signToken(claims)
+}
+
+// Verifies a challenge token and returns the ID of the user it was issued for,
+// the token is revoked so it can only be exchanged once
+func UseChallengeToken(challenge string) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := ParseToken(challenge, claims, jwt.WithAudience(challengeAudience))
+	if err != nil {
+		return 0, ErrInvalidChallenge
+	}
+
+	revoked, err := models.Models.Revoked.IsRevoked(claims.ID)
+	if err != nil {
+		return 0, err
+	}
+	if revoked {
+		return 0, ErrInvalidChallenge
+	}
+
+	err = models.Models.Revoked.Revoke(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, ErrInvalidChallenge
+	}
+
+	return userID, nil
+}
+
+// Starts a new session for the user on the device with the user agent and IP
+// and returns an access token bound to it alongside the refresh token used to renew it
+func NewSession(user *models.User, userAgent, ip string) (*TokenPair, error) {
+	session, refreshToken, err := models.Models.Session.New(user.ID, RefreshTokenTTL, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := CreateJwtToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:            accessToken,
+		RefreshToken:           refreshToken,
+		TwoFactorSetupRequired: needsTwoFactorSetup(user),
+	}, nil
+}
+
+// Rotates the refresh token and issues a new access token for the same session,
+// the user is looked up again so role changes are picked up
+func RefreshSession(refreshToken, userAgent, ip string) (*TokenPair, error) {
+	session, newRefreshToken, err := models.Models.Session.Rotate(refreshToken, RefreshTokenTTL, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := models.Models.User.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := CreateJwtToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	return rawToken.SignedString([]byte(signingKey))
+	return &TokenPair{
+		AccessToken:            accessToken,
+		RefreshToken:           newRefreshToken,
+		TwoFactorSetupRequired: needsTwoFactorSetup(user),
+	}, nil
 }
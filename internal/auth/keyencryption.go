@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+// The key-encryption key the private signing keys are encrypted with before they're stored,
+// 32 base64 encoded bytes. It's kept out of the database so a copy of it can't sign tokens
+var keyEncryptionKey = os.Getenv("SIGNING_KEY_ENCRYPTION_KEY")
+
+var errNoKeyEncryptionKey = errors.New("SIGNING_KEY_ENCRYPTION_KEY must be set to 32 base64 encoded bytes")
+
+var errSealedKeyTooShort = errors.New("encrypted private key is too short")
+
+func keyEncryptionCipher() (cipher.AEAD, error) {
+	kek, err := base64.StdEncoding.DecodeString(keyEncryptionKey)
+	if err != nil || len(kek) != 32 {
+		return nil, errNoKeyEncryptionKey
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the private key with AES-256-GCM, the nonce is stored in front of it.
+// The key ID is authenticated along with it so keys can't be swapped between rows
+func sealPrivateKey(kid string, private []byte) ([]byte, error) {
+	aead, err := keyEncryptionCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, private, []byte(kid)), nil
+}
+
+func openPrivateKey(kid string, sealed []byte) ([]byte, error) {
+	aead, err := keyEncryptionCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errSealedKeyTooShort
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(kid))
+}
@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"Sadeem-RestAPI/internal/models"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Running servers pick up keys rotated by other processes after this long
+	keyReloadInterval = time.Minute
+
+	// Tokens with a key ID we don't know make us look for new keys at most this often
+	keyMissReloadInterval = 10 * time.Second
+
+	rsaKeyBits = 2048
+)
+
+// Algorithm of the keys we generate, RS256 or EdDSA
+var SigningAlgorithm = signingAlgorithmFromEnv()
+
+// The old HS512 secret, when set tokens signed with it before the switch to
+// asymmetric keys are still accepted until they expire, it's never used to sign
+var legacySigningKey = os.Getenv("JWT_SIGNING_KEY")
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+func signingAlgorithmFromEnv() string {
+	if os.Getenv("JWT_SIGNING_ALGORITHM") == "EdDSA" {
+		return "EdDSA"
+	}
+	return "RS256"
+}
+
+// A signing key with its private key parsed
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	signs   bool
+}
+
+// The keys loaded from the database, reloaded every keyReloadInterval
+type keyRing struct {
+	mu           sync.RWMutex
+	current      *signingKey
+	verification map[string]*signingKey
+	loaded       time.Time
+}
+
+var keys = &keyRing{}
+
+// Loads the signing keys, creating the first one if there isn't any,
+// servers call it on startup so a broken key fails early
+func LoadKeys() error {
+	return keys.reload()
+}
+
+func (kr *keyRing) reload() error {
+	stored, err := models.Models.SigningKey.GetActive()
+	if err != nil {
+		return err
+	}
+
+	if len(stored) == 0 {
+		key, err := GenerateSigningKey(SigningAlgorithm)
+		if err != nil {
+			return err
+		}
+
+		err = models.Models.SigningKey.Insert(key)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, key)
+	}
+
+	var current *signingKey
+	verification := map[string]*signingKey{}
+	for _, key := range stored {
+		private, err := decryptSigningKey(key)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+
+		parsed, err := parseSigningKey(key, private)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+
+		// Keys come newest first so the first one that isn't retired signs
+		if current == nil && parsed.signs {
+			current = parsed
+		}
+		verification[parsed.id] = parsed
+	}
+
+	if current == nil {
+		return errors.New("every signing key has been retired, run the keys rotate command")
+	}
+
+	kr.mu.Lock()
+	kr.current = current
+	kr.verification = verification
+	kr.loaded = time.Now()
+	kr.mu.Unlock()
+
+	return nil
+}
+
+// Reloads the keys if the last load is older than maxAge
+func (kr *keyRing) refresh(maxAge time.Duration) error {
+	kr.mu.RLock()
+	stale := time.Since(kr.loaded) > maxAge
+	kr.mu.RUnlock()
+
+	if !stale {
+		return nil
+	}
+
+	return kr.reload()
+}
+
+func (kr *keyRing) signingKey() (*signingKey, error) {
+	err := kr.refresh(keyReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return kr.current, nil
+}
+
+func (kr *keyRing) verificationKey(kid string) (*signingKey, error) {
+	err := kr.refresh(keyReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	key, ok := kr.verification[kid]
+	kr.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	// The key may have been added by a rotation since the last reload
+	err = kr.refresh(keyMissReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	kr.mu.RLock()
+	key, ok = kr.verification[kid]
+	kr.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+
+	return key, nil
+}
+
+// Returns the PKCS #8 private key of the stored key, keys stored
+// before they were encrypted are encrypted in the database on the way
+func decryptSigningKey(key *models.SigningKey) ([]byte, error) {
+	if key.Encrypted {
+		return openPrivateKey(key.ID, key.PrivateKey)
+	}
+
+	private := key.PrivateKey
+	sealed, err := sealPrivateKey(key.ID, private)
+	if err != nil {
+		return nil, err
+	}
+
+	key.PrivateKey = sealed
+	err = models.Models.SigningKey.SetEncrypted(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return private, nil
+}
+
+// Creates a new key with a random ID, the private key is stored as
+// PKCS #8 encrypted with the key-encryption key
+func GenerateSigningKey(algorithm string) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	randomBytes := make([]byte, 8)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString(randomBytes)
+
+	sealed, err := sealPrivateKey(id, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		ID:         id,
+		Algorithm:  algorithm,
+		PrivateKey: sealed,
+		Encrypted:  true,
+	}, nil
+}
+
+func parseSigningKey(key *models.SigningKey, encoded []byte) (*signingKey, error) {
+	private, err := x509.ParsePKCS8PrivateKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &signingKey{
+		id:    key.ID,
+		signs: key.Retired == nil,
+	}
+
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm != "RS256" {
+			return nil, fmt.Errorf("RSA key stored as %s", key.Algorithm)
+		}
+		parsed.method = jwt.SigningMethodRS256
+		parsed.private = private
+	case ed25519.PrivateKey:
+		if key.Algorithm != "EdDSA" {
+			return nil, fmt.Errorf("Ed25519 key stored as %s", key.Algorithm)
+		}
+		parsed.method = jwt.SigningMethodEdDSA
+		parsed.private = private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	return parsed, nil
+}
+
+// Signs the claims with the current key, its ID goes into the kid header
+func signToken(claims jwt.Claims) (string, error) {
+	key, err := keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.private)
+}
+
+// Verifies a token signed by any of our keys that hasn't expired yet,
+// or by the legacy HS512 secret if it's still configured
+func ParseToken(rawToken string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	methods := []string{"RS256", "EdDSA"}
+	if legacySigningKey != "" {
+		methods = append(methods, "HS512")
+	}
+	options = append(options, jwt.WithValidMethods(methods))
+
+	return jwt.ParseWithClaims(rawToken, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() == "HS512" {
+			return []byte(legacySigningKey), nil
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		key, err := keys.verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.method.Alg() != t.Method.Alg() {
+			return nil, fmt.Errorf("token signed with %s but key %s is %s", t.Method.Alg(), kid, key.method.Alg())
+		}
+
+		return key.private.Public(), nil
+	}, options...)
+}
+
+// A public key in the JWK format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// The public keys other services need to verify our tokens,
+// retired keys are included until every token they signed has expired
+func PublicKeys() ([]JSONWebKey, error) {
+	err := keys.refresh(keyReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+
+	jwks := make([]JSONWebKey, 0, len(keys.verification))
+	for _, key := range keys.verification {
+		jwk := JSONWebKey{
+			Kid: key.id,
+			Use: "sig",
+			Alg: key.method.Alg(),
+		}
+
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+
+		jwks = append(jwks, jwk)
+	}
+
+	slices.SortFunc(jwks, func(a, b JSONWebKey) int {
+		return strings.Compare(a.Kid, b.Kid)
+	})
+
+	return jwks, nil
+}
@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"fmt"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anything that can deliver an email to a user
+type Mailer interface {
+	Send(recipient, subject, body string) error
+}
+
+// Picks the mailer based on the environment, if SMTP_HOST is set emails
+// are sent over SMTP, otherwise they are written to MAIL_OUTBOX_DIR
+func New() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		return &OutboxMailer{Dir: dir}
+	}
+
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = 587
+	}
+
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		Sender:   os.Getenv("SMTP_SENDER"),
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Sender   string
+}
+
+func (m *SMTPMailer) Send(recipient, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	msg := buildMessage(m.Sender, recipient, subject, body)
+
+	return smtp.SendMail(addr, auth, m.Sender, []string{recipient}, msg)
+}
+
+// Writes every email to a file instead of sending it,
+// handy for local development and tests
+type OutboxMailer struct {
+	Dir string
+}
+
+func (m *OutboxMailer) Send(recipient, subject, body string) error {
+	err := os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(recipient))
+	msg := buildMessage("outbox@localhost", recipient, subject, body)
+
+	return os.WriteFile(filepath.Join(m.Dir, fileName), msg, 0o644)
+}
+
+func buildMessage(sender, recipient, subject, body string) []byte {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "From: %s\r\n", sender)
+	fmt.Fprintf(&sb, "To: %s\r\n", recipient)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(body)
+
+	return []byte(sb.String())
+}
+
+// Keeps only characters that are safe to use in a file name
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
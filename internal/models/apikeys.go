@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Every key starts with this so they are easy to spot when leaked
+const apiKeyPrefix = "sdm_"
+
+// Personal API keys for scripts and other machine clients,
+// only the hash of the key is stored
+type ApiKey struct {
+	ID       int64      `json:"ID"`
+	UserID   int        `json:"-"`
+	Name     string     `json:"name" validate:"required"`
+	Scopes   []string   `json:"scopes"`
+	Expiry   time.Time  `json:"expiry"`
+	LastUsed *time.Time `json:"lastUsed"`
+	Created  time.Time  `json:"created"`
+}
+
+type ApiKeyModel struct {
+	DB *pgxpool.Pool
+}
+
+// Stores the key and returns the plain text version of it,
+// this is the only time the plain text key is available
+func (am *ApiKeyModel) Insert(key *ApiKey) (string, error) {
+	plainText, _, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	plainText = apiKeyPrefix + plainText
+
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+
+	statement := `
+  INSERT INTO api_keys (user_id, name, hash, scopes, expiry)
+  VALUES ($1, $2, $3, $4, $5)
+  RETURNING id, created
+  `
+	args := []any{key.UserID, key.Name, hashToken(plainText), key.Scopes, key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = am.DB.QueryRow(ctx, statement, args...).Scan(&key.ID, &key.Created)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+func (am *ApiKeyModel) GetAllForUser(userID int) ([]*ApiKey, error) {
+	statement := `
+  SELECT id, user_id, name, scopes, expiry, last_used, created FROM api_keys
+  WHERE user_id = $1
+  ORDER BY created DESC
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := am.DB.Query(ctx, statement, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*ApiKey{}
+
+	for rows.Next() {
+		var key ApiKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Scopes,
+			&key.Expiry,
+			&key.LastUsed,
+			&key.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Looks up an unexpired key and the user it belongs to,
+// the last used time of the key is updated on the way
+func (am *ApiKeyModel) GetByKey(plainText string) (*ApiKey, *User, error) {
+	statement := `
+  UPDATE api_keys
+  SET last_used = NOW()
+  FROM users
+  WHERE api_keys.hash = $1
+  AND api_keys.expiry > NOW()
+  AND users.id = api_keys.user_id
+  RETURNING api_keys.id, api_keys.name, api_keys.scopes, api_keys.expiry, api_keys.created, users.id, users.name, users.email
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key := &ApiKey{}
+	user := &User{}
+
+	err := am.DB.QueryRow(ctx, statement, hashToken(plainText)).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Scopes,
+		&key.Expiry,
+		&key.Created,
+		&user.ID,
+		&user.UserName,
+		&user.Email,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+
+	key.UserID = user.ID
+
+	return key, user, nil
+}
+
+func (am *ApiKeyModel) Delete(id int64, userID int) error {
+	statement := `
+  DELETE FROM api_keys
+  WHERE id = $1 AND user_id = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := am.DB.Exec(ctx, statement, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
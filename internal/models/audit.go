@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Actions written to the audit log
+const (
+	AuditImpersonationStart   = "impersonation.start"
+	AuditImpersonationRequest = "impersonation.request"
+)
+
+// Something a staff member did on behalf of a user, the names are
+// copied so entries stay readable after users are renamed or deleted
+type AuditEntry struct {
+	ID        int64     `json:"ID"`
+	ActorID   int       `json:"actorID"`
+	ActorName string    `json:"actorName"`
+	UserID    int       `json:"userID"`
+	UserName  string    `json:"userName"`
+	Action    string    `json:"action"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+}
+
+type AuditModel struct {
+	DB *pgxpool.Pool
+}
+
+func (am *AuditModel) Insert(entry *AuditEntry) error {
+	statement := `
+  INSERT INTO audit_log (actor_id, actor_name, user_id, user_name, action, method, path, status, ip)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+  RETURNING id, created
+  `
+	args := []any{
+		entry.ActorID,
+		entry.ActorName,
+		entry.UserID,
+		entry.UserName,
+		entry.Action,
+		entry.Method,
+		entry.Path,
+		entry.Status,
+		entry.IP,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return am.DB.QueryRow(ctx, statement, args...).Scan(&entry.ID, &entry.Created)
+}
+
+// Returns a page of the entries, optionally only the ones by or about a user
+func (am *AuditModel) GetAll(actorName, userName string, filters Filters) ([]*AuditEntry, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(3)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	statement := fmt.Sprintf(`
+  SELECT %s, id, actor_id, actor_name, user_id, user_name, action, method, path, status, ip, created FROM audit_log
+  WHERE ($1 = '' OR actor_name = $1)
+  AND ($2 = '' OR user_name = $2)
+  AND %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), keyset, filters.orderBy(), filters.limitOffset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := am.DB.Query(ctx, statement, append([]any{actorName, userName}, keysetArgs...)...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	totalRecords := 0
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*AuditEntry, error) {
+		var entry AuditEntry
+		err := row.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.ActorID,
+			&entry.ActorName,
+			&entry.UserID,
+			&entry.UserName,
+			&entry.Action,
+			&entry.Method,
+			&entry.Path,
+			&entry.Status,
+			&entry.IP,
+			&entry.Created,
+		)
+		return &entry, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	entries, metadata := paginate(filters, entries, totalRecords, func(entry *AuditEntry, column string) any {
+		if column == "created" {
+			return entry.Created
+		}
+		return entry.ID
+	})
+
+	return entries, metadata, nil
+}
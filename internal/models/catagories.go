@@ -2,60 +2,251 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrDuplicateCategoryName = errors.New("category name already taken")
+	ErrDuplicateCategorySlug = errors.New("category slug already taken")
+)
+
 type Catagory struct {
-	ID   int    `json:"-"`
-	Name string `json:"name" validate:"required"`
+	ID           int    `json:"id"`
+	Name         string `json:"name" validate:"required"`
+	Description  string `json:"description"`
+	Icon         string `json:"icon"`
+	Slug         string `json:"slug,omitempty" validate:"omitempty,slug"`
+	DisplayOrder int    `json:"displayOrder"`
+	Archived     bool   `json:"archived"`
+	ParentID     *int   `json:"-"`
+
+	// ID, slug or name of the parent when creating a category under another one
+	Parent string `json:"parent,omitempty"`
+	// Subcategories created along with the category, and the branches of the tree
+	Children []*Catagory `json:"children,omitempty" validate:"omitempty,dive"`
 }
 
 type CatagoryModel struct {
 	DB *pgxpool.Pool
 }
 
-func (cm *CatagoryModel) Insert(c *Catagory) error {
-	statement := `
-  INSERT INTO categories (name)
-  VALUES ($1)
+// Finds a category by its ID, slug or name in that order, so a category
+// named like another one's ID or slug can still be found by its own.
+// $1 is the reference and $2 the reference as a number, or NULL if it isn't one
+const resolveCategoryStatement = `
+  SELECT id FROM categories
+  WHERE id = $2 OR slug = $1 OR name = $1
+  ORDER BY COALESCE(id = $2, false) DESC, COALESCE(slug = $1, false) DESC
+  LIMIT 1
   `
 
+// Returns the ID of the category with the reference as its ID, slug or name
+func (cm *CatagoryModel) Resolve(ref string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := cm.DB.Exec(ctx, statement, &c.Name)
+	var id int
+	err := cm.DB.QueryRow(ctx, resolveCategoryStatement, ref, refAsID(ref)).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func refAsID(ref string) *int64 {
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &id
+}
+
+// Creates the category under its parent if it has one, along with
+// all of its children, the whole subtree is created or none of it
+func (cm *CatagoryModel) Insert(c *Catagory) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := cm.DB.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	if c.Parent != "" {
+		var parentID int
+		err = tx.QueryRow(ctx, resolveCategoryStatement, c.Parent, refAsID(c.Parent)).Scan(&parentID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		c.ParentID = &parentID
+	}
+
+	err = insertSubtree(ctx, tx, c)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (cm *CatagoryModel) DeleteByName(name string) error {
+func insertSubtree(ctx context.Context, tx pgx.Tx, c *Catagory) error {
 	statement := `
+  INSERT INTO categories (name, description, icon, slug, display_order, archived, parent_id)
+  VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)
+  RETURNING id
+  `
+
+	err := tx.QueryRow(ctx, statement, c.Name, c.Description, c.Icon, c.Slug, c.DisplayOrder, c.Archived, c.ParentID).Scan(&c.ID)
+	if err != nil {
+		return categoryError(err)
+	}
+
+	for _, child := range c.Children {
+		child.ParentID = &c.ID
+		err = insertSubtree(ctx, tx, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The changes to a category, fields left nil stay as they are
+type CategoryChanges struct {
+	Name         *string
+	Description  *string
+	Icon         *string
+	Slug         *string
+	DisplayOrder *int
+	Archived     *bool
+}
+
+// Applies the changes to the category and returns it as it is now, renaming
+// keeps the activations since they point at the ID and not the name.
+// An empty slug removes it
+func (cm *CatagoryModel) Update(id int, changes CategoryChanges) (*Catagory, error) {
+	statement := fmt.Sprintf(`
+  UPDATE categories
+  SET
+  name = COALESCE($2, name),
+  description = COALESCE($3, description),
+  icon = COALESCE($4, icon),
+  slug = CASE WHEN $5::text IS NULL THEN slug ELSE NULLIF($5, '') END,
+  display_order = COALESCE($6, display_order),
+  archived = COALESCE($7, archived)
+  WHERE id = $1
+  RETURNING %s
+  `, categoryColumns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cat := &Catagory{}
+	err := cm.DB.QueryRow(ctx, statement,
+		id,
+		changes.Name,
+		changes.Description,
+		changes.Icon,
+		changes.Slug,
+		changes.DisplayOrder,
+		changes.Archived,
+	).Scan(cat.scanTargets()...)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, categoryError(err)
+	}
+
+	return cat, nil
+}
+
+// Columns of a category in the order scanTargets expects them
+const categoryColumns = `id, name, description, icon, COALESCE(slug, ''), display_order, archived`
+
+func (c *Catagory) scanTargets() []any {
+	return []any{&c.ID, &c.Name, &c.Description, &c.Icon, &c.Slug, &c.DisplayOrder, &c.Archived}
+}
+
+// Turns unique violations into the errors for the taken name or slug
+func categoryError(err error) error {
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+		switch pgerr.ConstraintName {
+		case "categories_name_key", "category_translations_locale_name_key":
+			return ErrDuplicateCategoryName
+		case "categories_slug_key":
+			return ErrDuplicateCategorySlug
+		}
+	}
+
+	return err
+}
+
+// Deletes the category, its children move up to its parent
+func (cm *CatagoryModel) Delete(id int) error {
+	reparentStatement := `
+  UPDATE categories
+  SET parent_id = (SELECT parent_id FROM categories WHERE id = $1)
+  WHERE parent_id = $1
+  `
+	deleteStatement := `
   DELETE FROM categories
-  WHERE name = ($1)
+  WHERE id = $1
   `
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := cm.DB.Exec(ctx, statement, name)
+	tx, err := cm.DB.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	_, err = tx.Exec(ctx, reparentStatement, id)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(ctx, deleteStatement, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (cm *CatagoryModel) EditOnUser(userName string, categories []string, activate bool) error {
+// Activates or deactivates the categories for the user, with includeSubcategories
+// activating a category also shows everything under it, even categories added later,
+// and deactivating it takes away the activations of everything under it too
+func (cm *CatagoryModel) EditOnUser(userName string, categoryIDs []int, activate bool, includeSubcategories bool) error {
 	activateTemplate := `
-  INSERT INTO user_categories (user_id, category_id)
+  INSERT INTO user_categories (user_id, category_id, include_descendants)
   VALUES
-  ((SELECT id FROM users WHERE name = $1), (SELECT id FROM categories WHERE name = $2))
+  ((SELECT id FROM users WHERE name = $1), $2, $3)
+  ON CONFLICT (user_id, category_id) DO UPDATE
+  SET include_descendants = EXCLUDED.include_descendants
   `
 
 	deactivateTemplate := `
@@ -63,25 +254,41 @@ func (cm *CatagoryModel) EditOnUser(userName string, categories []string, activa
   WHERE
   user_id = (SELECT id FROM users WHERE name = $1)
   AND
-  category_id = (SELECT id FROM categories WHERE name = $2)
+  category_id = $2
+  `
+
+	deactivateSubtreeTemplate := `
+  WITH RECURSIVE subtree AS (
+    SELECT id FROM categories WHERE id = $2
+    UNION
+    SELECT categories.id FROM categories
+    JOIN subtree
+    ON categories.parent_id = subtree.id
+  )
+  DELETE FROM user_categories
+  WHERE
+  user_id = (SELECT id FROM users WHERE name = $1)
+  AND
+  category_id IN (SELECT id FROM subtree)
   `
 
 	batch := &pgx.Batch{}
 
-	for _, category := range categories {
-		switch activate {
-		case true:
-			batch.Queue(activateTemplate, userName, category)
-		case false:
-			batch.Queue(deactivateTemplate, userName, category)
+	for _, id := range categoryIDs {
+		switch {
+		case activate:
+			batch.Queue(activateTemplate, userName, id, includeSubcategories)
+		case includeSubcategories:
+			batch.Queue(deactivateSubtreeTemplate, userName, id)
+		default:
+			batch.Queue(deactivateTemplate, userName, id)
 		}
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	br := cm.DB.SendBatch(ctx, batch)
-	_, err := br.Exec()
+	err := cm.DB.SendBatch(ctx, batch).Close()
 	if err != nil {
 		return err
 	}
@@ -105,66 +312,69 @@ func (um *CatagoryModel) Exists(id int) error {
 	return nil
 }
 
-func (um *CatagoryModel) GetAll(filters Filters) ([]*Catagory, Metadata, error) {
-	statement := fmt.Sprintf(`
-  SELECT count(*) OVER(), name FROM categories
-  ORDER BY name %s, id ASC
-  LIMIT %d OFFSET %d `, filters.sortDirection(), filters.limit(), filters.offset())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	rows, err := um.DB.Query(ctx, statement)
+// Returns a page of every category in the first of the locales they're translated to,
+// search only keeps the ones with it in their name
+func (um *CatagoryModel) GetAll(search string, locales []string, filters Filters) ([]*Catagory, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(3)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
 
-	defer rows.Close()
-
-	totalRecords := 0
-	categories := []*Catagory{}
+	// we use Sprintf because we can't use variables in the some of the paramaters
+	statement := fmt.Sprintf(`
+  SELECT %s, %s FROM %s
+  WHERE ($1 = '' OR strpos(lower(name), lower($1)) > 0)
+  AND %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), categoryColumns, localizedCategories(2), keyset, filters.orderBy(), filters.limitOffset())
 
-	for rows.Next() {
-		var cat Catagory
+	return um.queryPage(statement, append([]any{search, locales}, keysetArgs...), filters)
+}
 
-		err := rows.Scan(
-			&totalRecords,
-			&cat.Name,
-		)
-		if err != nil {
-			return nil, Metadata{}, err
-		}
+// The "visible" CTE with the IDs of the categories the user with the ID in userID can see, the ones
+// activated for them or for a group they're in and everything under the ones activated with their subcategories.
+// userID is a parameter like $1, or a column to use it for every row of an outer query
+func visibleCategories(userID string) string {
+	return fmt.Sprintf(`visible AS (
+    SELECT category_id::bigint AS id, include_descendants FROM user_categories
+    WHERE user_id = %[1]s
+    UNION
+    SELECT category_id, include_descendants FROM group_categories
+    WHERE group_id IN (SELECT group_id FROM group_members WHERE user_id = %[1]s)
+    UNION
+    SELECT categories.id, true FROM categories
+    JOIN visible
+    ON categories.parent_id = visible.id
+    WHERE visible.include_descendants
+  )`, userID)
+}
 
-		categories = append(categories, &cat)
+// Returns a page of the categories activated for the user, searched and sorted the same way as GetAll.
+// Archived categories are left out
+func (um *CatagoryModel) GetAllActive(userID int, search string, locales []string, filters Filters) ([]*Catagory, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(4)
+	if err != nil {
+		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
-
-	return categories, metadata, nil
+	statement := fmt.Sprintf(`
+  WITH RECURSIVE %s
+  SELECT %s, %s FROM %s
+  WHERE id IN (SELECT id FROM visible)
+  AND NOT archived
+  AND ($2 = '' OR strpos(lower(name), lower($2)) > 0)
+  AND %s
+  ORDER BY %s
+  %s`, visibleCategories("$1"), filters.totalRecordsColumn(), categoryColumns, localizedCategories(3), keyset, filters.orderBy(), filters.limitOffset())
+
+	return um.queryPage(statement, append([]any{userID, search, locales}, keysetArgs...), filters)
 }
 
-func (um *CatagoryModel) GetAllActive(userID int, filters Filters) ([]*Catagory, Metadata, error) {
-	// we use Sprintf because we can't use variables in the some of the paramaters
-	// statement := fmt.Sprintf(`
-	// SELECT count(*) OVER(), categories.name FROM categories
-	// JOIN user_categories
-	// ON categories.id = user_categories.category_id
-	// WHERE user_categories.user_id = %d
-	// ORDER BY name %s, id ASC
-	// LIMIT %d OFFSET %d `, userID, filters.sortDirection(), filters.limit(), filters.offset())
-
-	statement := `
-  SELECT count(*) OVER(), categories.name FROM categories
-  JOIN user_categories
-  ON categories.id = user_categories.category_id
-  JOIN users 
-  ON user_categories.user_id = users.id 
-  WHERE user_categories.user_id = $1`
-
+func (um *CatagoryModel) queryPage(statement string, args []any, filters Filters) ([]*Catagory, Metadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := um.DB.Query(ctx, statement, userID)
+	rows, err := um.DB.Query(ctx, statement, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -177,10 +387,7 @@ func (um *CatagoryModel) GetAllActive(userID int, filters Filters) ([]*Catagory,
 	for rows.Next() {
 		var cat Catagory
 
-		err := rows.Scan(
-			&totalRecords,
-			&cat.Name,
-		)
+		err := rows.Scan(append([]any{&totalRecords}, cat.scanTargets()...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -188,7 +395,16 @@ func (um *CatagoryModel) GetAllActive(userID int, filters Filters) ([]*Catagory,
 		categories = append(categories, &cat)
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	categories, metadata := paginate(filters, categories, totalRecords, func(cat *Catagory, column string) any {
+		if column == "name" {
+			return cat.Name
+		}
+		return cat.ID
+	})
 
 	return categories, metadata, nil
 }
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The name and description of a category in another locale
+type CategoryTranslation struct {
+	Locale      string `json:"locale"`
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+}
+
+// The categories with their name and description in the first of the locales in the
+// parameter that has a translation, or as they are when none of them does.
+// It has the same columns as the categories table so it can be used in its place
+func localizedCategories(localesParam int) string {
+	return fmt.Sprintf(`(
+    SELECT
+    categories.id,
+    COALESCE(translation.name, categories.name) AS name,
+    COALESCE(NULLIF(translation.description, ''), categories.description) AS description,
+    categories.icon,
+    categories.slug,
+    categories.display_order,
+    categories.archived,
+    categories.parent_id
+    FROM categories
+    LEFT JOIN LATERAL (
+      SELECT name, description FROM category_translations
+      WHERE category_id = categories.id
+      AND locale = ANY($%[1]d::text[])
+      ORDER BY array_position($%[1]d::text[], locale)
+      LIMIT 1
+    ) translation ON true
+  ) AS localized`, localesParam)
+}
+
+// Returns the translations of the category sorted by locale
+func (cm *CatagoryModel) GetTranslations(id int) ([]*CategoryTranslation, error) {
+	existsStatement := `
+  SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)
+  `
+
+	statement := `
+  SELECT locale, name, description FROM category_translations
+  WHERE category_id = $1
+  ORDER BY locale
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	exists := false
+	err := cm.DB.QueryRow(ctx, existsStatement, id).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrRecordNotFound
+	}
+
+	rows, err := cm.DB.Query(ctx, statement, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	translations := []*CategoryTranslation{}
+
+	for rows.Next() {
+		var translation CategoryTranslation
+
+		err := rows.Scan(
+			&translation.Locale,
+			&translation.Name,
+			&translation.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		translations = append(translations, &translation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return translations, nil
+}
+
+// Adds the translation to the category or replaces the one it has for the locale
+func (cm *CatagoryModel) SetTranslation(id int, translation *CategoryTranslation) error {
+	statement := `
+  INSERT INTO category_translations (category_id, locale, name, description)
+  SELECT id, $2, $3, $4 FROM categories
+  WHERE id = $1
+  ON CONFLICT (category_id, locale) DO UPDATE
+  SET name = EXCLUDED.name, description = EXCLUDED.description
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := cm.DB.Exec(ctx, statement, id, translation.Locale, translation.Name, translation.Description)
+	if err != nil {
+		return categoryError(err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (cm *CatagoryModel) DeleteTranslation(id int, locale string) error {
+	statement := `
+  DELETE FROM category_translations
+  WHERE category_id = $1
+  AND locale = $2
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := cm.DB.Exec(ctx, statement, id, locale)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrCategoryCycle = errors.New("category can't be moved under itself")
+
+// Moves the category under the parent, a nil parent makes it a root.
+// A category can't be moved under itself or any of its descendants
+func (cm *CatagoryModel) Move(id int, parentID *int) error {
+	lockStatement := `
+  LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE
+  `
+
+	existsStatement := `
+  SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)
+  `
+
+	// Walks up from the new parent, if we meet the category on the way it would end up under itself
+	cycleStatement := `
+  WITH RECURSIVE ancestors AS (
+    SELECT id, parent_id FROM categories WHERE id = $1
+    UNION
+    SELECT categories.id, categories.parent_id FROM categories
+    JOIN ancestors
+    ON categories.id = ancestors.parent_id
+  )
+  SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)
+  `
+
+	moveStatement := `
+  UPDATE categories
+  SET parent_id = $2
+  WHERE id = $1
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := cm.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Two moves running at once could each pass the check and make a cycle together
+	_, err = tx.Exec(ctx, lockStatement)
+	if err != nil {
+		return err
+	}
+
+	// Either of them may have been deleted since they were looked up
+	for _, categoryID := range []*int{&id, parentID} {
+		if categoryID == nil {
+			continue
+		}
+
+		exists := false
+		err = tx.QueryRow(ctx, existsStatement, *categoryID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRecordNotFound
+		}
+	}
+
+	if parentID != nil {
+		cycle := false
+		err = tx.QueryRow(ctx, cycleStatement, *parentID, id).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	_, err = tx.Exec(ctx, moveStatement, id, parentID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Returns the categories as a forest sorted by display order and name, in the first of the
+// locales they're translated to. Without all only the categories visible to the user that
+// aren't archived are included, the ones whose parent they can't see become roots
+func (cm *CatagoryModel) GetTree(userID int, all bool, locales []string) ([]*Catagory, error) {
+	statement := fmt.Sprintf(`
+  SELECT %s, parent_id FROM %s
+  `, categoryColumns, localizedCategories(1))
+	args := []any{locales}
+
+	if !all {
+		statement = fmt.Sprintf(`
+  WITH RECURSIVE %s
+  SELECT %s, parent_id FROM %s
+  WHERE id IN (SELECT id FROM visible)
+  AND NOT archived
+  `, visibleCategories("$1"), categoryColumns, localizedCategories(2))
+		args = []any{userID, locales}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := cm.DB.Query(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	byID := map[int]*Catagory{}
+	categories := []*Catagory{}
+
+	for rows.Next() {
+		var cat Catagory
+
+		err := rows.Scan(append(cat.scanTargets(), &cat.ParentID)...)
+		if err != nil {
+			return nil, err
+		}
+
+		byID[cat.ID] = &cat
+		categories = append(categories, &cat)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].DisplayOrder != categories[j].DisplayOrder {
+			return categories[i].DisplayOrder < categories[j].DisplayOrder
+		}
+		return categories[i].Name < categories[j].Name
+	})
+
+	roots := []*Catagory{}
+	for _, cat := range categories {
+		if cat.ParentID != nil {
+			if parent, ok := byID[*cat.ParentID]; ok {
+				parent.Children = append(parent.Children, cat)
+				continue
+			}
+		}
+
+		roots = append(roots, cat)
+	}
+
+	return roots, nil
+}
@@ -1,22 +1,109 @@
 package models
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Filters struct {
 	Page         int    `json:"page"`
 	PageSize     int    `json:"pageSize"`
 	Sort         string `json:"sort,omitempty"`
 	SortSafeList []string
+
+	// Keyset pagination, the page is ignored when UseCursor is set. Without a cursor
+	// the first page is returned, or the last one when Backwards is set,
+	// After and Before come from the metadata of another page
+	UseCursor bool   `json:"-"`
+	Backwards bool   `json:"-"`
+	After     string `json:"after,omitempty"`
+	Before    string `json:"before,omitempty"`
+}
+
+// A column the rows are ordered by
+type sortKey struct {
+	column string
+	desc   bool
 }
 
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+// The fields of the sort, for example "-created,name" sorts by created
+// in descending order and then by name
+func (f Filters) sortFields() []string {
+	fields := []string{}
+	for _, field := range strings.Split(f.Sort, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
 	}
-	return "ASC"
+
+	return fields
+}
+
+// Returns the first field of the sort that isn't in the safe list,
+// or that sorts by a column that's already been sorted by
+func (f Filters) UnknownSortField() string {
+	seen := []string{}
+	for _, field := range f.sortFields() {
+		column := strings.TrimPrefix(field, "-")
+		if !slices.Contains(f.SortSafeList, field) || slices.Contains(seen, column) {
+			return field
+		}
+		seen = append(seen, column)
+	}
+
+	return ""
+}
+
+// The columns to order by, every field is checked against the safe list
+// again since they end up in the query as they are
+func (f Filters) sortKeys() []sortKey {
+	if field := f.UnknownSortField(); field != "" {
+		panic("unsafe sort parameter: " + field)
+	}
+
+	keys := []sortKey{}
+	hasID := false
+	for _, field := range f.sortFields() {
+		column := strings.TrimPrefix(field, "-")
+		keys = append(keys, sortKey{column: column, desc: strings.HasPrefix(field, "-")})
+		hasID = hasID || column == "id"
+	}
+
+	// Rows with the same values are kept in a stable order across pages
+	if !hasID {
+		keys = append(keys, sortKey{column: "id"})
+	}
+
+	return keys
+}
+
+// Builds the ORDER BY clause from the sort, when paging backwards
+// with a cursor the order is flipped and the rows are flipped back later
+func (f Filters) orderBy() string {
+	clauses := []string{}
+	for _, key := range f.sortKeys() {
+		direction := "ASC"
+		if key.desc != f.backwards() {
+			direction = "DESC"
+		}
+		clauses = append(clauses, key.column+" "+direction)
+	}
+
+	return strings.Join(clauses, ", ")
+}
+
+func (f Filters) backwards() bool {
+	return f.UseCursor && (f.Backwards || f.Before != "")
 }
 
 func (f Filters) limit() int {
@@ -27,12 +114,177 @@ func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
 
+// The LIMIT and OFFSET of the query, with a cursor one more row is
+// fetched to find out whether there is another page
+func (f Filters) limitOffset() string {
+	if f.UseCursor {
+		return fmt.Sprintf("LIMIT %d", f.limit()+1)
+	}
+
+	return fmt.Sprintf("LIMIT %d OFFSET %d", f.limit(), f.offset())
+}
+
+// Counting every row is what makes offsets slow on big tables,
+// so it's skipped with a cursor and the metadata has no page numbers
+func (f Filters) totalRecordsColumn() string {
+	if f.UseCursor {
+		return "0"
+	}
+
+	return "count(*) OVER()"
+}
+
+// Builds the condition that only keeps the rows after (or before) the cursor,
+// parameters are numbered from firstParam and their values are returned alongside
+func (f Filters) keysetCondition(firstParam int) (string, []any, error) {
+	raw := f.After
+	if f.backwards() {
+		raw = f.Before
+	}
+	if !f.UseCursor || raw == "" {
+		return "TRUE", nil, nil
+	}
+
+	values, err := f.decodeCursor(raw)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// (a > $1) OR (a = $1 AND b > $2) OR (a = $1 AND b = $2 AND id > $3)
+	keys := f.sortKeys()
+	alternatives := []string{}
+	for i, key := range keys {
+		conditions := []string{}
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", keys[j].column, firstParam+j))
+		}
+
+		operator := ">"
+		if key.desc != f.backwards() {
+			operator = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s $%d", key.column, operator, firstParam+i))
+
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+
+	return "(" + strings.Join(alternatives, " OR ") + ")", values, nil
+}
+
+// What a cursor holds, the sort it was made for and the values of
+// the sort columns of the row it points at
+type cursor struct {
+	Sort   string        `json:"s"`
+	Values []cursorValue `json:"v"`
+}
+
+// Values keep their type so they're compared with the columns as they are
+type cursorValue struct {
+	Type  string `json:"t"`
+	Value string `json:"v"`
+}
+
+// The type the cursor values of each sortable column have to be, so a
+// tampered cursor can't compare a column with a value of another type
+var cursorColumnTypes = map[string]string{
+	"id":      "int",
+	"created": "time",
+	"name":    "text",
+	"email":   "text",
+}
+
+// Returns false if the After or Before cursor can't be used with this sort
+func (f Filters) CursorIsValid() bool {
+	for _, raw := range []string{f.After, f.Before} {
+		if raw == "" {
+			continue
+		}
+		if _, err := f.decodeCursor(raw); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f Filters) decodeCursor(raw string) ([]any, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := cursor{}
+	err = json.Unmarshal(decoded, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Sort != strings.Join(f.sortFields(), ",") || len(c.Values) != len(f.sortKeys()) {
+		return nil, ErrInvalidCursor
+	}
+
+	values := []any{}
+	for i, key := range f.sortKeys() {
+		value := c.Values[i]
+		if value.Type != cursorColumnTypes[key.column] {
+			return nil, ErrInvalidCursor
+		}
+
+		switch value.Type {
+		case "int":
+			number, err := strconv.ParseInt(value.Value, 10, 64)
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			values = append(values, number)
+		case "time":
+			timestamp, err := time.Parse(time.RFC3339Nano, value.Value)
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			values = append(values, timestamp)
+		case "text":
+			values = append(values, value.Value)
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return values, nil
+}
+
+// Builds the cursor pointing at a row, value returns the row's value for a sort column
+func (f Filters) encodeCursor(value func(column string) any) string {
+	c := cursor{Sort: strings.Join(f.sortFields(), ",")}
+
+	for _, key := range f.sortKeys() {
+		switch v := value(key.column).(type) {
+		case int:
+			c.Values = append(c.Values, cursorValue{"int", strconv.Itoa(v)})
+		case int64:
+			c.Values = append(c.Values, cursorValue{"int", strconv.FormatInt(v, 10)})
+		case time.Time:
+			c.Values = append(c.Values, cursorValue{"time", v.Format(time.RFC3339Nano)})
+		case string:
+			c.Values = append(c.Values, cursorValue{"text", v})
+		default:
+			panic(fmt.Sprintf("can't build a cursor from column %s of type %T", key.column, v))
+		}
+	}
+
+	encoded, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
 type Metadata struct {
-	CurrentPage  int `json:"currentPage,omitempty"`
-	PageSize     int `json:"pageSize,omitempty"`
-	FirstPage    int `json:"firstPage,omitempty"`
-	LastPage     int `json:"lastPage,omitempty"`
-	TotalRecords int `json:"totalRecords,omitempty"`
+	CurrentPage  int    `json:"currentPage,omitempty"`
+	PageSize     int    `json:"pageSize,omitempty"`
+	FirstPage    int    `json:"firstPage,omitempty"`
+	LastPage     int    `json:"lastPage,omitempty"`
+	TotalRecords int    `json:"totalRecords,omitempty"`
+	NextCursor   string `json:"nextCursor,omitempty"`
+	PrevCursor   string `json:"prevCursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -49,3 +301,58 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// Builds the metadata of a page of rows, value returns a row's value for a sort column.
+// Cursors are included with page numbers too so clients can switch to them,
+// with a cursor the extra row fetched to look for another page is dropped
+func paginate[T any](f Filters, rows []T, totalRecords int, value func(row T, column string) any) ([]T, Metadata) {
+	cursorFor := func(row T) string {
+		return f.encodeCursor(func(column string) any { return value(row, column) })
+	}
+
+	if !f.UseCursor {
+		metadata := calculateMetadata(totalRecords, f.Page, f.PageSize)
+		if len(rows) > 0 {
+			if f.Page*f.PageSize < totalRecords {
+				metadata.NextCursor = cursorFor(rows[len(rows)-1])
+			}
+			if f.Page > 1 {
+				metadata.PrevCursor = cursorFor(rows[0])
+			}
+		}
+		return rows, metadata
+	}
+
+	hasMore := len(rows) > f.PageSize
+	if hasMore {
+		rows = rows[:f.PageSize]
+	}
+	if f.backwards() {
+		slices.Reverse(rows)
+	}
+
+	metadata := Metadata{PageSize: f.PageSize}
+	if len(rows) == 0 {
+		return rows, metadata
+	}
+
+	// Paging backwards from a cursor its row comes after this page,
+	// paging forwards from a cursor its row comes before it
+	if f.backwards() {
+		if f.Before != "" {
+			metadata.NextCursor = cursorFor(rows[len(rows)-1])
+		}
+		if hasMore {
+			metadata.PrevCursor = cursorFor(rows[0])
+		}
+	} else {
+		if hasMore {
+			metadata.NextCursor = cursorFor(rows[len(rows)-1])
+		}
+		if f.After != "" {
+			metadata.PrevCursor = cursorFor(rows[0])
+		}
+	}
+
+	return rows, metadata
+}
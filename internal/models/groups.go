@@ -0,0 +1,380 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrDuplicateGroupName = errors.New("group name already taken")
+
+// Users in a group see every category activated for the group on top of their own
+type Group struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name" validate:"required"`
+	Created time.Time `json:"created"`
+	Members int       `json:"members"`
+}
+
+// A category activated for a group
+type GroupCategory struct {
+	ID                   int    `json:"id"`
+	Name                 string `json:"name"`
+	IncludeSubcategories bool   `json:"includeSubcategories"`
+}
+
+type GroupModel struct {
+	DB *pgxpool.Pool
+}
+
+func (gm *GroupModel) Insert(group *Group) error {
+	statement := `
+  INSERT INTO groups (name)
+  VALUES ($1)
+  RETURNING id, created
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := gm.DB.QueryRow(ctx, statement, group.Name).Scan(&group.ID, &group.Created)
+	if err != nil {
+		var pgerr *pgconn.PgError
+		if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+			return ErrDuplicateGroupName
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns a page of the groups with the number of users in each
+func (gm *GroupModel) GetAll(filters Filters) ([]*Group, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(1)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	statement := fmt.Sprintf(`
+  SELECT %s, id, name, created, members FROM (
+    SELECT groups.id, groups.name, groups.created, count(group_members.user_id) AS members
+    FROM groups
+    LEFT JOIN group_members
+    ON group_members.group_id = groups.id
+    GROUP BY groups.id
+  ) AS groups
+  WHERE %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), keyset, filters.orderBy(), filters.limitOffset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := gm.DB.Query(ctx, statement, keysetArgs...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	groups := []*Group{}
+
+	for rows.Next() {
+		var group Group
+
+		err := rows.Scan(&totalRecords, &group.ID, &group.Name, &group.Created, &group.Members)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		groups = append(groups, &group)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	groups, metadata := paginate(filters, groups, totalRecords, func(group *Group, column string) any {
+		switch column {
+		case "name":
+			return group.Name
+		case "created":
+			return group.Created
+		}
+		return group.ID
+	})
+
+	return groups, metadata, nil
+}
+
+// Deletes the group, its members lose the categories they only saw through it
+func (gm *GroupModel) Delete(name string) error {
+	statement := `
+  DELETE FROM groups
+  WHERE name = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := gm.DB.Exec(ctx, statement, name)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Returns ErrRecordNotFound if there is no group with the name
+func (gm *GroupModel) getID(ctx context.Context, name string) (int, error) {
+	statement := `
+  SELECT id FROM groups
+  WHERE name = $1
+  `
+
+	var id int
+	err := gm.DB.QueryRow(ctx, statement, name).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrRecordNotFound
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Returns a page of the users in the group
+func (gm *GroupModel) GetMembers(name string, filters Filters) ([]*User, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(2)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	statement := fmt.Sprintf(`
+  SELECT %s, id, name, email, created FROM users
+  WHERE id IN (SELECT user_id FROM group_members WHERE group_id = $1)
+  AND %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), keyset, filters.orderBy(), filters.limitOffset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	groupID, err := gm.getID(ctx, name)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	rows, err := gm.DB.Query(ctx, statement, append([]any{groupID}, keysetArgs...)...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(&totalRecords, &user.ID, &user.UserName, &user.Email, &user.Created)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	users, metadata := paginate(filters, users, totalRecords, func(user *User, column string) any {
+		switch column {
+		case "name":
+			return user.UserName
+		case "email":
+			return user.Email
+		case "created":
+			return user.Created
+		}
+		return user.ID
+	})
+
+	return users, metadata, nil
+}
+
+// Adds the users to the group, users already in it are left as they are.
+// Nobody is added if any of the users doesn't exist
+func (gm *GroupModel) AddMembers(name string, userNames []string) error {
+	statement := `
+  INSERT INTO group_members (group_id, user_id)
+  SELECT $1, id FROM users
+  WHERE name = ANY($2)
+  ON CONFLICT DO NOTHING
+  `
+
+	countStatement := `
+  SELECT count(*) FROM users
+  WHERE name = ANY($1)
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	groupID, err := gm.getID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := gm.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	unique := map[string]bool{}
+	for _, userName := range userNames {
+		unique[userName] = true
+	}
+
+	var found int
+	err = tx.QueryRow(ctx, countStatement, userNames).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(unique) {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, statement, groupID, userNames)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (gm *GroupModel) RemoveMember(name string, userName string) error {
+	statement := `
+  DELETE FROM group_members
+  WHERE group_id = (SELECT id FROM groups WHERE name = $1)
+  AND user_id = (SELECT id FROM users WHERE name = $2)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := gm.DB.Exec(ctx, statement, name, userName)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Returns the categories activated for the group sorted by name
+func (gm *GroupModel) GetCategories(name string) ([]*GroupCategory, error) {
+	statement := `
+  SELECT categories.id, categories.name, group_categories.include_descendants FROM categories
+  JOIN group_categories
+  ON group_categories.category_id = categories.id
+  WHERE group_categories.group_id = $1
+  ORDER BY categories.name
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	groupID, err := gm.getID(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := gm.DB.Query(ctx, statement, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	categories := []*GroupCategory{}
+
+	for rows.Next() {
+		var category GroupCategory
+
+		err := rows.Scan(&category.ID, &category.Name, &category.IncludeSubcategories)
+		if err != nil {
+			return nil, err
+		}
+
+		categories = append(categories, &category)
+	}
+
+	return categories, rows.Err()
+}
+
+// Activates or deactivates the categories for every member of the group,
+// includeSubcategories works the same way as with CatagoryModel.EditOnUser
+func (gm *GroupModel) EditCategories(name string, categoryIDs []int, activate bool, includeSubcategories bool) error {
+	activateTemplate := `
+  INSERT INTO group_categories (group_id, category_id, include_descendants)
+  VALUES ($1, $2, $3)
+  ON CONFLICT (group_id, category_id) DO UPDATE
+  SET include_descendants = EXCLUDED.include_descendants
+  `
+
+	deactivateTemplate := `
+  DELETE FROM group_categories
+  WHERE group_id = $1 AND category_id = $2
+  `
+
+	deactivateSubtreeTemplate := `
+  WITH RECURSIVE subtree AS (
+    SELECT id FROM categories WHERE id = $2
+    UNION
+    SELECT categories.id FROM categories
+    JOIN subtree
+    ON categories.parent_id = subtree.id
+  )
+  DELETE FROM group_categories
+  WHERE group_id = $1
+  AND category_id IN (SELECT id FROM subtree)
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	groupID, err := gm.getID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+
+	for _, id := range categoryIDs {
+		switch {
+		case activate:
+			batch.Queue(activateTemplate, groupID, id, includeSubcategories)
+		case includeSubcategories:
+			batch.Queue(deactivateSubtreeTemplate, groupID, id)
+		default:
+			batch.Queue(deactivateTemplate, groupID, id)
+		}
+	}
+
+	return gm.DB.SendBatch(ctx, batch).Close()
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"Sadeem-RestAPI/internal/hasher"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrInvalidLoginState = errors.New("invalid or expired login state")
+	ErrDuplicateUserName = errors.New("user name already taken")
+	ErrDuplicateEmail    = errors.New("email already taken")
+)
+
+// An account at an external OpenID Connect provider linked to one of our users
+type Identity struct {
+	ID       int64     `json:"id"`
+	UserID   int       `json:"-"`
+	Provider string    `json:"provider"`
+	Subject  string    `json:"-"`
+	Email    string    `json:"email"`
+	Created  time.Time `json:"created"`
+}
+
+// External identities and the state of logins that are waiting on the provider
+type IdentityModel struct {
+	DB *pgxpool.Pool
+}
+
+// Stores what we need to finish a login once the provider redirects back
+// and returns the state to send with the authorization request,
+// only a hash of the state is stored
+func (im *IdentityModel) NewLoginState(provider, codeVerifier, nonce string, ttl time.Duration) (string, error) {
+	state, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	insertStatement := `
+  INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, expiry)
+  VALUES ($1, $2, $3, $4, $5)
+  `
+	cleanupStatement := `
+  DELETE FROM oidc_login_states
+  WHERE expiry < NOW()
+  `
+
+	batch := &pgx.Batch{}
+	batch.Queue(insertStatement, hash, provider, codeVerifier, nonce, time.Now().Add(ttl))
+	batch.Queue(cleanupStatement)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = im.DB.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return "", err
+	}
+
+	return state, nil
+}
+
+// Deletes the login state and returns the PKCE verifier and nonce stored with it,
+// so every state can only finish one login
+func (im *IdentityModel) UseLoginState(state, provider string) (codeVerifier, nonce string, err error) {
+	statement := `
+  DELETE FROM oidc_login_states
+  WHERE state_hash = $1 AND provider = $2 AND expiry > NOW()
+  RETURNING code_verifier, nonce
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = im.DB.QueryRow(ctx, statement, hashToken(state), provider).Scan(&codeVerifier, &nonce)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", ErrInvalidLoginState
+		}
+		return "", "", err
+	}
+
+	return codeVerifier, nonce, nil
+}
+
+// Returns the user the external identity is linked to
+func (im *IdentityModel) GetUser(provider, subject string) (*User, error) {
+	statement := `
+  SELECT user_id FROM user_identities
+  WHERE provider = $1 AND subject = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := im.DB.QueryRow(ctx, statement, provider, subject).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+
+	return Models.User.GetUserByID(userID)
+}
+
+// Links an external identity to an existing user
+func (im *IdentityModel) Link(identity *Identity) error {
+	statement := `
+  INSERT INTO user_identities (user_id, provider, subject, email)
+  VALUES ($1, $2, $3, $4)
+  RETURNING id, created
+  `
+	args := []any{identity.UserID, identity.Provider, identity.Subject, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return im.DB.QueryRow(ctx, statement, args...).Scan(&identity.ID, &identity.Created)
+}
+
+// Creates a verified user for someone logging in with an external identity for the first time,
+// the user gets a random password they can replace through the password reset
+func (im *IdentityModel) Provision(user *User, identity *Identity) error {
+	hashedPassword, err := hasher.Hash(user.UnhashedPassword)
+	if err != nil {
+		return err
+	}
+
+	userStatement := `
+  INSERT INTO users (name, email, hashed_password, profile_picture_path, verified, verified_email)
+  VALUES ($1, $2, $3, $4, true, $2)
+  RETURNING id, created
+  `
+	identityStatement := `
+  INSERT INTO user_identities (user_id, provider, subject, email)
+  VALUES ($1, $2, $3, $4)
+  RETURNING id, created
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := im.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, userStatement, user.UserName, user.Email, []byte(hashedPassword), defaultPFP).Scan(&user.ID, &user.Created)
+	if err != nil {
+		var pgerr *pgconn.PgError
+		if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+			switch pgerr.ConstraintName {
+			case "users_name_key":
+				return ErrDuplicateUserName
+			case "users_email_key":
+				return ErrDuplicateEmail
+			}
+		}
+		return err
+	}
+
+	identity.UserID = user.ID
+	err = tx.QueryRow(ctx, identityStatement, identity.UserID, identity.Provider, identity.Subject, identity.Email).Scan(&identity.ID, &identity.Created)
+	if err != nil {
+		return err
+	}
+
+	user.Verified = true
+	user.PicturePath = defaultPFP
+
+	return tx.Commit(ctx)
+}
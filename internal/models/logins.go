@@ -0,0 +1,231 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// After maxFailedLogins wrong passwords in a row the account is locked,
+// every failure after that doubles the lockout up to maxLockout
+const (
+	maxFailedLogins = 5
+	baseLockout     = time.Minute
+	maxLockout      = 24 * time.Hour
+
+	// Failed attempts allowed from a single IP inside ipWindow, no matter the account
+	maxFailedLoginsPerIP = 20
+	ipWindow             = 15 * time.Minute
+)
+
+var (
+	ErrAccountLocked     = errors.New("account is temporarily locked")
+	ErrTooManyAttempts   = errors.New("too many failed login attempts from this ip")
+	ErrIncorrectPassword = errors.New("incorrect password")
+)
+
+type LoginAttempt struct {
+	ID      int64     `json:"ID"`
+	UserID  *int      `json:"userID"`
+	Email   string    `json:"email"`
+	IP      string    `json:"ip"`
+	Success bool      `json:"success"`
+	Created time.Time `json:"created"`
+}
+
+// How long the account stays locked after the given number of failures in a row
+func lockoutDuration(failedLogins int) time.Duration {
+	if failedLogins < maxFailedLogins {
+		return 0
+	}
+
+	lockout := baseLockout * time.Duration(math.Pow(2, float64(failedLogins-maxFailedLogins)))
+	if lockout <= 0 || lockout > maxLockout {
+		return maxLockout
+	}
+
+	return lockout
+}
+
+func (um *UserModel) checkIPThrottle(ip string) error {
+	statement := `
+  SELECT count(*) FROM login_attempts
+  WHERE ip = $1 AND success = false AND created > $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures int
+	err := um.DB.QueryRow(ctx, statement, ip, time.Now().Add(-ipWindow)).Scan(&failures)
+	if err != nil {
+		return err
+	}
+
+	if failures >= maxFailedLoginsPerIP {
+		return ErrTooManyAttempts
+	}
+
+	return nil
+}
+
+func (um *UserModel) recordLoginAttempt(userID *int, email, ip string, success bool) error {
+	statement := `
+  INSERT INTO login_attempts (user_id, email, ip, success)
+  VALUES ($1, $2, $3, $4)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := um.DB.Exec(ctx, statement, userID, email, ip, success)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Counts the failure against the account and locks it once there are too many,
+// returns ErrAccountLocked if this failure locked the account
+func (um *UserModel) registerFailedLogin(user *User, ip string) error {
+	err := um.recordLoginAttempt(&user.ID, user.Email, ip, false)
+	if err != nil {
+		return err
+	}
+
+	statement := `
+  UPDATE users
+  SET failed_logins = failed_logins + 1
+  WHERE id = $1
+  RETURNING failed_logins
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failedLogins int
+	err = um.DB.QueryRow(ctx, statement, user.ID).Scan(&failedLogins)
+	if err != nil {
+		return err
+	}
+
+	lockout := lockoutDuration(failedLogins)
+	if lockout == 0 {
+		return ErrIncorrectPassword
+	}
+
+	lockedUntil := time.Now().Add(lockout)
+
+	lockStatement := `
+  UPDATE users
+  SET locked_until = $1
+  WHERE id = $2
+  `
+	_, err = um.DB.Exec(ctx, lockStatement, lockedUntil, user.ID)
+	if err != nil {
+		return err
+	}
+
+	user.LockedUntil = &lockedUntil
+
+	return ErrAccountLocked
+}
+
+func (um *UserModel) registerSuccessfulLogin(user *User, ip string) error {
+	err := um.recordLoginAttempt(&user.ID, user.Email, ip, true)
+	if err != nil {
+		return err
+	}
+
+	statement := `
+  UPDATE users
+  SET failed_logins = 0, locked_until = NULL
+  WHERE id = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = um.DB.Exec(ctx, statement, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Lifts the lockout of the account and resets its failure counter
+func (um *UserModel) Unlock(userName string) error {
+	statement := `
+  UPDATE users
+  SET failed_logins = 0, locked_until = NULL
+  WHERE name = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := um.DB.Exec(ctx, statement, userName)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Returns a page of the login attempts, optionally only the ones
+// for an email, from an ip, or only the failed ones
+func (um *UserModel) GetLoginAttempts(email, ip string, failedOnly bool, filters Filters) ([]*LoginAttempt, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(4)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	statement := fmt.Sprintf(`
+  SELECT %s, id, user_id, email, ip, success, created FROM login_attempts
+  WHERE ($1 = '' OR email = $1)
+  AND ($2 = '' OR ip = $2)
+  AND (NOT $3 OR success = false)
+  AND %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), keyset, filters.orderBy(), filters.limitOffset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := um.DB.Query(ctx, statement, append([]any{email, ip, failedOnly}, keysetArgs...)...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	totalRecords := 0
+	attempts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*LoginAttempt, error) {
+		var attempt LoginAttempt
+		err := row.Scan(
+			&totalRecords,
+			&attempt.ID,
+			&attempt.UserID,
+			&attempt.Email,
+			&attempt.IP,
+			&attempt.Success,
+			&attempt.Created,
+		)
+		return &attempt, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	attempts, metadata := paginate(filters, attempts, totalRecords, func(attempt *LoginAttempt, column string) any {
+		if column == "created" {
+			return attempt.Created
+		}
+		return attempt.ID
+	})
+
+	return attempts, metadata, nil
+}
@@ -1,8 +1,21 @@
 package models
 
+import "errors"
+
 var Models *ModelStruct
 
+var ErrRecordNotFound = errors.New("record not found")
+
 type ModelStruct struct {
-	User     *UserModel
-	Catagory *CatagoryModel
+	User       *UserModel
+	Catagory   *CatagoryModel
+	Session    *SessionModel
+	Revoked    *RevocationModel
+	Token      *TokenModel
+	Role       *RoleModel
+	ApiKey     *ApiKeyModel
+	Identity   *IdentityModel
+	SigningKey *SigningKeyModel
+	Audit      *AuditModel
+	Group      *GroupModel
 }
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Keeps track of access tokens that were revoked before they expired,
+// revoked IDs are cached in memory so we only hit the database once per token
+type RevocationModel struct {
+	DB *pgxpool.Pool
+
+	mu    sync.RWMutex
+	cache map[string]time.Time
+}
+
+// Adds the token ID to the revocation list until the token expires,
+// expired entries are cleaned up on the way
+func (rm *RevocationModel) Revoke(jti string, expiry time.Time) error {
+	insertStatement := `
+  INSERT INTO revoked_tokens (jti, expiry)
+  VALUES ($1, $2)
+  ON CONFLICT (jti) DO NOTHING
+  `
+	cleanupStatement := `
+  DELETE FROM revoked_tokens
+  WHERE expiry < NOW()
+  `
+
+	batch := &pgx.Batch{}
+	batch.Queue(insertStatement, jti, expiry)
+	batch.Queue(cleanupStatement)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := rm.DB.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return err
+	}
+
+	rm.cacheRevoked(jti, expiry)
+
+	return nil
+}
+
+func (rm *RevocationModel) IsRevoked(jti string) (bool, error) {
+	rm.mu.RLock()
+	_, cached := rm.cache[jti]
+	rm.mu.RUnlock()
+
+	if cached {
+		return true, nil
+	}
+
+	statement := `
+  SELECT expiry FROM revoked_tokens
+  WHERE jti = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var expiry time.Time
+	err := rm.DB.QueryRow(ctx, statement, jti).Scan(&expiry)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	rm.cacheRevoked(jti, expiry)
+
+	return true, nil
+}
+
+func (rm *RevocationModel) cacheRevoked(jti string, expiry time.Time) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.cache == nil {
+		rm.cache = make(map[string]time.Time)
+	}
+
+	// No point remembering tokens that would be rejected for expiring anyway
+	now := time.Now()
+	for id, exp := range rm.cache {
+		if exp.Before(now) {
+			delete(rm.cache, id)
+		}
+	}
+
+	rm.cache[jti] = expiry
+}
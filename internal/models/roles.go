@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Permissions are granted to roles, and roles to users, the
+// permissions a user has end up as scopes in their token
+const (
+	PermissionCategoriesRead       = "categories:read"
+	PermissionCategoriesWrite      = "categories:write"
+	PermissionUsersRead            = "users:read"
+	PermissionUsersWrite           = "users:write"
+	PermissionUserCategoriesAssign = "user-categories:assign"
+	PermissionRolesWrite           = "roles:write"
+	PermissionUsersImpersonate     = "users:impersonate"
+	PermissionGroupsRead           = "groups:read"
+	PermissionGroupsWrite          = "groups:write"
+)
+
+const RoleAdmin = "admin"
+
+var ErrLastAdmin = errors.New("can't remove the last admin")
+
+type Role struct {
+	ID          int      `json:"-"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB *pgxpool.Pool
+}
+
+func (rm *RoleModel) GetAll() ([]*Role, error) {
+	statement := `
+  SELECT roles.id, roles.name,
+    COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+  FROM roles
+  LEFT JOIN role_permissions
+  ON role_permissions.role_id = roles.id
+  LEFT JOIN permissions
+  ON permissions.id = role_permissions.permission_id
+  GROUP BY roles.id
+  ORDER BY roles.name
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := rm.DB.Query(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, &role.Permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	return roles, rows.Err()
+}
+
+// Returns every user that has the role
+func (rm *RoleModel) GetUsersWithRole(role string) ([]*User, error) {
+	statement := `
+  SELECT users.id, users.name, users.email, users.created FROM users
+  JOIN user_roles
+  ON user_roles.user_id = users.id
+  JOIN roles
+  ON roles.id = user_roles.role_id
+  WHERE roles.name = $1
+  ORDER BY users.name
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := rm.DB.Query(ctx, statement, role)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(&user.ID, &user.UserName, &user.Email, &user.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		user.Roles = []string{role}
+		user.IsAdmin = role == RoleAdmin
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// Gives the user the role, granting a role the user already has does nothing
+func (rm *RoleModel) Grant(userName, role string) error {
+	statement := `
+  INSERT INTO user_roles (user_id, role_id)
+  SELECT users.id, roles.id FROM users, roles
+  WHERE users.name = $1 AND roles.name = $2
+  ON CONFLICT DO NOTHING
+  RETURNING user_id
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := rm.DB.QueryRow(ctx, statement, userName, role).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return rm.checkUserAndRole(userName, role)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Takes the role away from the user, the last admin can't be removed so
+// there is always someone left who can manage roles
+func (rm *RoleModel) Revoke(userName, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := rm.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if role == RoleAdmin {
+		err = checkNotLastAdmin(ctx, tx, userName)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleteStatement := `
+  DELETE FROM user_roles
+  WHERE user_id = (SELECT id FROM users WHERE name = $1)
+  AND role_id = (SELECT id FROM roles WHERE name = $2)
+  `
+	result, err := tx.Exec(ctx, deleteStatement, userName, role)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Returns ErrLastAdmin if the user is the only admin left. The admin rows stay locked
+// until the transaction ends so two admins can't demote or delete each other at the same time
+func checkNotLastAdmin(ctx context.Context, tx pgx.Tx, userName string) error {
+	lockStatement := `
+  SELECT users.name FROM user_roles
+  JOIN roles
+  ON roles.id = user_roles.role_id
+  JOIN users
+  ON users.id = user_roles.user_id
+  WHERE roles.name = $1
+  FOR UPDATE OF user_roles
+  `
+	rows, err := tx.Query(ctx, lockStatement, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	admins, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	if len(admins) == 1 && admins[0] == userName {
+		return ErrLastAdmin
+	}
+
+	return nil
+}
+
+// Tells apart a user or role that doesn't exist from a role that was already granted
+func (rm *RoleModel) checkUserAndRole(userName, role string) error {
+	statement := `
+  SELECT
+    EXISTS(SELECT 1 FROM users WHERE name = $1),
+    EXISTS(SELECT 1 FROM roles WHERE name = $2)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userExists, roleExists bool
+	err := rm.DB.QueryRow(ctx, statement, userName, role).Scan(&userExists, &roleExists)
+	if err != nil {
+		return err
+	}
+
+	if !userExists || !roleExists {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// A session is created on every login, it holds the hash of the
+// refresh token the client uses to get new access tokens
+type Session struct {
+	ID        int64     `json:"ID"`
+	UserID    int       `json:"-"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expiry    time.Time `json:"expiry"`
+	Created   time.Time `json:"created"`
+
+	// Set when listing sessions for the one the request was sent from
+	Current bool `json:"current"`
+}
+
+// User agents are cut to this length before they are stored
+const maxUserAgentLength = 512
+
+type SessionModel struct {
+	DB *pgxpool.Pool
+}
+
+// Generates a random token, returning the plain text version we hand
+// to the client and the sha256 hash of it that we store
+func generateToken() (string, []byte, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plainText := base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(plainText))
+
+	return plainText, hash[:], nil
+}
+
+func hashToken(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
+
+// Creates a new session for the user and returns it alongside
+// the plain text refresh token, the user agent and IP identify the device
+func (sm *SessionModel) New(userID int, ttl time.Duration, userAgent, ip string) (*Session, string, error) {
+	refreshToken, hash, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &Session{
+		UserID:    userID,
+		UserAgent: truncateUserAgent(userAgent),
+		IP:        ip,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	statement := `
+  INSERT INTO sessions (user_id, refresh_token_hash, expiry, user_agent, ip)
+  VALUES ($1, $2, $3, $4, $5)
+  RETURNING id, created, last_seen
+  `
+	args := []any{session.UserID, hash, session.Expiry, session.UserAgent, session.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = sm.DB.QueryRow(ctx, statement, args...).Scan(&session.ID, &session.Created, &session.LastSeen)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, refreshToken, nil
+}
+
+// Swaps the refresh token of a session for a new one, the old token
+// can't be used again after this, the device info is updated since the IP may have changed
+func (sm *SessionModel) Rotate(refreshToken string, ttl time.Duration, userAgent, ip string) (*Session, string, error) {
+	newRefreshToken, newHash, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &Session{
+		UserAgent: truncateUserAgent(userAgent),
+		IP:        ip,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	statement := `
+  UPDATE sessions
+  SET refresh_token_hash = $1, expiry = $2, user_agent = $4, ip = $5, last_seen = NOW()
+  WHERE refresh_token_hash = $3 AND expiry > NOW()
+  RETURNING id, user_id, created, last_seen
+  `
+	args := []any{newHash, session.Expiry, hashToken(refreshToken), session.UserAgent, session.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = sm.DB.QueryRow(ctx, statement, args...).Scan(&session.ID, &session.UserID, &session.Created, &session.LastSeen)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, "", ErrInvalidToken
+		}
+		return nil, "", err
+	}
+
+	return session, newRefreshToken, nil
+}
+
+// Returns true if the session exists and has not expired, the last seen
+// time is bumped along the way but at most once a minute to spare the writes
+func (sm *SessionModel) IsActive(id int64) (bool, error) {
+	statement := `
+  WITH session AS (
+    SELECT id, last_seen FROM sessions
+    WHERE id = $1 AND expiry > NOW()
+  ), touched AS (
+    UPDATE sessions SET last_seen = NOW()
+    WHERE id IN (SELECT id FROM session WHERE last_seen < NOW() - INTERVAL '1 minute')
+  )
+  SELECT EXISTS(SELECT 1 FROM session)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var active bool
+	err := sm.DB.QueryRow(ctx, statement, id).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+// Returns the user's sessions that haven't expired, the most recently used first
+func (sm *SessionModel) GetAllForUser(userID int) ([]*Session, error) {
+	statement := `
+  SELECT id, user_id, user_agent, ip, last_seen, expiry, created FROM sessions
+  WHERE user_id = $1 AND expiry > NOW()
+  ORDER BY last_seen DESC
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := sm.DB.Query(ctx, statement, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		err = rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IP,
+			&session.LastSeen,
+			&session.Expiry,
+			&session.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (sm *SessionModel) Delete(id int64, userID int) error {
+	statement := `
+  DELETE FROM sessions
+  WHERE id = $1 AND user_id = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := sm.DB.Exec(ctx, statement, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Ends every session of the user, logging them out on all devices
+func (sm *SessionModel) DeleteAllForUser(userID int) error {
+	statement := `
+  DELETE FROM sessions
+  WHERE user_id = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := sm.DB.Exec(ctx, statement, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Ends every session of the user except the given one, used when the
+// password changes so the user stays logged in on the device they used
+func (sm *SessionModel) DeleteAllExcept(userID int, id int64) error {
+	statement := `
+  DELETE FROM sessions
+  WHERE user_id = $1 AND id != $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := sm.DB.Exec(ctx, statement, userID, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func truncateUserAgent(userAgent string) string {
+	runes := []rune(userAgent)
+	if len(runes) > maxUserAgentLength {
+		return string(runes[:maxUserAgentLength])
+	}
+
+	return userAgent
+}
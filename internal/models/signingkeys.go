@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A key used to sign our JWTs, only the newest key that hasn't been retired signs new tokens,
+// retired keys are still used to verify tokens until they expire
+type SigningKey struct {
+	ID         string     `json:"kid"`
+	Algorithm  string     `json:"algorithm"`
+	PrivateKey []byte     `json:"-"`
+	Encrypted  bool       `json:"-"`
+	Created    time.Time  `json:"created"`
+	Retired    *time.Time `json:"retired"`
+	Expiry     *time.Time `json:"expiry"`
+}
+
+type SigningKeyModel struct {
+	DB *pgxpool.Pool
+}
+
+// Returns every key that can still verify tokens, newest first
+func (sm *SigningKeyModel) GetActive() ([]*SigningKey, error) {
+	statement := `
+  SELECT id, algorithm, private_key, encrypted, created, retired, expiry FROM signing_keys
+  WHERE expiry IS NULL OR expiry > NOW()
+  ORDER BY created DESC
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := sm.DB.Query(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		key := &SigningKey{}
+		err = rows.Scan(&key.ID, &key.Algorithm, &key.PrivateKey, &key.Encrypted, &key.Created, &key.Retired, &key.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (sm *SigningKeyModel) Insert(key *SigningKey) error {
+	statement := `
+  INSERT INTO signing_keys (id, algorithm, private_key, encrypted)
+  VALUES ($1, $2, $3, $4)
+  RETURNING created
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return sm.DB.QueryRow(ctx, statement, key.ID, key.Algorithm, key.PrivateKey, key.Encrypted).Scan(&key.Created)
+}
+
+// Replaces a key stored before keys were encrypted with its encrypted version
+func (sm *SigningKeyModel) SetEncrypted(key *SigningKey) error {
+	statement := `
+  UPDATE signing_keys
+  SET private_key = $1, encrypted = true
+  WHERE id = $2 AND NOT encrypted
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := sm.DB.Exec(ctx, statement, key.PrivateKey, key.ID)
+	if err != nil {
+		return err
+	}
+
+	key.Encrypted = true
+
+	return nil
+}
+
+// Makes the new key the one that signs tokens, the keys it replaces keep
+// verifying tokens for the grace period and expired keys are deleted
+func (sm *SigningKeyModel) Rotate(key *SigningKey, grace time.Duration) error {
+	retireStatement := `
+  UPDATE signing_keys
+  SET retired = NOW(), expiry = $1
+  WHERE retired IS NULL
+  `
+	insertStatement := `
+  INSERT INTO signing_keys (id, algorithm, private_key, encrypted)
+  VALUES ($1, $2, $3, $4)
+  RETURNING created
+  `
+	cleanupStatement := `
+  DELETE FROM signing_keys
+  WHERE expiry < NOW()
+  `
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := sm.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, retireStatement, time.Now().Add(grace))
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(ctx, insertStatement, key.ID, key.Algorithm, key.PrivateKey, key.Encrypted).Scan(&key.Created)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, cleanupStatement)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
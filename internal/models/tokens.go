@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Scopes of the one time tokens we send to users
+const (
+	ScopePasswordReset = "password-reset"
+	ScopeVerification  = "verification"
+)
+
+// One time tokens, only the hash is stored and a token
+// is deleted as soon as it's used
+type TokenModel struct {
+	DB *pgxpool.Pool
+}
+
+// Creates a new token for the user and returns the plain text version of it,
+// any older tokens with the same scope are removed
+func (tm *TokenModel) New(userID int, ttl time.Duration, scope string) (string, error) {
+	plainText, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	deleteStatement := `
+  DELETE FROM tokens
+  WHERE user_id = $1 AND scope = $2
+  `
+	insertStatement := `
+  INSERT INTO tokens (hash, user_id, expiry, scope)
+  VALUES ($1, $2, $3, $4)
+  `
+
+	batch := &pgx.Batch{}
+	batch.Queue(deleteStatement, userID, scope)
+	batch.Queue(insertStatement, hash, userID, time.Now().Add(ttl), scope)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = tm.DB.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// Deletes the token and returns the ID of the user it belongs to,
+// so a token can only ever be used once
+func (tm *TokenModel) Use(plainText string, scope string) (int, error) {
+	statement := `
+  DELETE FROM tokens
+  WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+  RETURNING user_id
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := tm.DB.QueryRow(ctx, statement, hashToken(plainText), scope).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// Returns the ID of the user the token belongs to without using the token up
+func (tm *TokenModel) GetUserID(plainText string, scope string) (int, error) {
+	statement := `
+  SELECT user_id FROM tokens
+  WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int
+	err := tm.DB.QueryRow(ctx, statement, hashToken(plainText), scope).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
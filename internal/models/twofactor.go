@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+	ErrTOTPCodeReused      = errors.New("totp code has already been used")
+)
+
+// Stores a new TOTP secret for the user, 2FA stays disabled
+// until they confirm it with a code from their authenticator
+func (um *UserModel) SetTOTPSecret(id int, secret string) error {
+	statement := `
+  UPDATE users
+  SET totp_secret = $1, totp_enabled = false, totp_last_step = 0
+  WHERE id = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := um.DB.Exec(ctx, statement, secret, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (um *UserModel) GetTOTP(id int) (secret string, enabled bool, err error) {
+	statement := `
+  SELECT COALESCE(totp_secret, ''), totp_enabled FROM users
+  WHERE id = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = um.DB.QueryRow(ctx, statement, id).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, err
+	}
+
+	return secret, enabled, nil
+}
+
+// Records the time step of a code that was just used, a code
+// from the same or an earlier step can't be used again
+func (um *UserModel) UseTOTPStep(id int, step int64) error {
+	statement := `
+  UPDATE users
+  SET totp_last_step = $1
+  WHERE id = $2 AND totp_last_step < $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := um.DB.Exec(ctx, statement, step, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+// Turns on 2FA and replaces any previous recovery codes with the new ones
+func (um *UserModel) EnableTOTP(id int, recoveryCodes []string) error {
+	enableStatement := `
+  UPDATE users
+  SET totp_enabled = true
+  WHERE id = $1
+  `
+	deleteStatement := `
+  DELETE FROM recovery_codes
+  WHERE user_id = $1
+  `
+	insertStatement := `
+  INSERT INTO recovery_codes (user_id, hash)
+  VALUES ($1, $2)
+  `
+
+	batch := &pgx.Batch{}
+	batch.Queue(enableStatement, id)
+	batch.Queue(deleteStatement, id)
+	for _, code := range recoveryCodes {
+		batch.Queue(insertStatement, id, hashToken(code))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := um.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (um *UserModel) DisableTOTP(id int) error {
+	disableStatement := `
+  UPDATE users
+  SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0
+  WHERE id = $1
+  `
+	deleteStatement := `
+  DELETE FROM recovery_codes
+  WHERE user_id = $1
+  `
+
+	batch := &pgx.Batch{}
+	batch.Queue(disableStatement, id)
+	batch.Queue(deleteStatement, id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.SendBatch(ctx, batch).Close()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Recovery codes can only be used once, so they are deleted when used
+func (um *UserModel) UseRecoveryCode(id int, code string) error {
+	statement := `
+  DELETE FROM recovery_codes
+  WHERE user_id = $1 AND hash = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := um.DB.Exec(ctx, statement, id, hashToken(code))
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	return nil
+}
@@ -1,42 +1,61 @@
 package models
 
 import (
+	"Sadeem-RestAPI/internal/hasher"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var defaultPFP = os.Getenv("DEFAULT_PROFILE_PICTURE")
 
+var ErrUserNotVerified = errors.New("user has not verified their email")
+
+// A hash made with the current settings of a password nobody has, unknown emails are checked
+// against it so they take as long as known ones and the timing doesn't give them away
+var dummyPasswordHash, _ = hasher.Hash("not anyone's password")
+
 type User struct {
 	ID               int       `json:"ID"`
 	UserName         string    `json:"userName" validate:"required"`
 	Email            string    `json:"email" validate:"required,email"`
-	UnhashedPassword string    `json:"password" validate:"required"`
+	UnhashedPassword string    `json:"password" validate:"required,password"`
 	Created          time.Time `json:"created"`
 	PicturePath      string
 	IsAdmin          bool
+	Roles            []string
+	Permissions      []string
+	Verified         bool
+	TOTPEnabled      bool
+	LockedUntil      *time.Time
 }
 
 // Custom marshaling function so we only show information we want to show
 func (u *User) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		ID       int    `json:"ID"`
-		UserName string `json:"userName"`
-		Email    string `json:"email"`
-		IsAdmin  bool   `json:"isAdmin"`
+		ID          int      `json:"ID"`
+		UserName    string   `json:"userName"`
+		Email       string   `json:"email"`
+		IsAdmin     bool     `json:"isAdmin"`
+		Roles       []string `json:"roles"`
+		Verified    bool     `json:"verified"`
+		TOTPEnabled bool     `json:"twoFactorEnabled"`
 	}{
-		ID:       u.ID,
-		UserName: u.UserName,
-		Email:    u.Email,
-		IsAdmin:  u.IsAdmin,
+		ID:          u.ID,
+		UserName:    u.UserName,
+		Email:       u.Email,
+		IsAdmin:     u.IsAdmin,
+		Roles:       u.Roles,
+		Verified:    u.Verified,
+		TOTPEnabled: u.TOTPEnabled,
 	})
 }
 
@@ -45,7 +64,7 @@ type UserModel struct {
 }
 
 func (um *UserModel) Insert(user *User) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.UnhashedPassword), 12)
+	hashedPassword, err := hasher.Hash(user.UnhashedPassword)
 	if err != nil {
 		return err
 	}
@@ -55,7 +74,7 @@ func (um *UserModel) Insert(user *User) error {
   VALUES ($1, $2, $3, $4)
   RETURNING id
   `
-	args := []any{user.UserName, user.Email, string(hashedPassword), defaultPFP}
+	args := []any{user.UserName, user.Email, []byte(hashedPassword), defaultPFP}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -86,6 +105,7 @@ func (um *UserModel) Exists(id int) error {
 	return nil
 }
 
+// Deletes the user, returns ErrLastAdmin if they're the only admin left
 func (um *UserModel) DeleteUser(name string) error {
 	statement := `
   DELETE FROM users WHERE name = ($1)
@@ -93,12 +113,23 @@ func (um *UserModel) DeleteUser(name string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := um.DB.Exec(ctx, statement, name)
+	tx, err := um.DB.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	err = checkNotLastAdmin(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, statement, name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (um *UserModel) GetProfilePicture(userName string) (string, error) {
@@ -124,7 +155,7 @@ func (um *UserModel) GetUserByName(userName string) (*User, error) {
 	user := new(User)
 
 	statement := `
-  SELECT id, name, email, created, profile_picture_path FROM users
+  SELECT id, name, email, created, profile_picture_path, verified, totp_enabled FROM users
   WHERE name = ($1)
   `
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -136,6 +167,8 @@ func (um *UserModel) GetUserByName(userName string) (*User, error) {
 		&user.Email,
 		&user.Created,
 		&user.PicturePath,
+		&user.Verified,
+		&user.TOTPEnabled,
 	)
 	if err != nil {
 		return nil, err
@@ -145,6 +178,92 @@ func (um *UserModel) GetUserByName(userName string) (*User, error) {
 	return user, nil
 }
 
+func (um *UserModel) GetUserByID(id int) (*User, error) {
+	user := new(User)
+
+	statement := `
+  SELECT id, name, email, created, profile_picture_path, verified, totp_enabled FROM users
+  WHERE id = ($1)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.QueryRow(ctx, statement, id).Scan(
+		&user.ID,
+		&user.UserName,
+		&user.Email,
+		&user.Created,
+		&user.PicturePath,
+		&user.Verified,
+		&user.TOTPEnabled,
+	)
+	if err != nil {
+		return nil, err
+	}
+	um.SetUserRole(user)
+
+	return user, nil
+}
+
+func (um *UserModel) GetUserByEmail(email string) (*User, error) {
+	user := new(User)
+
+	statement := `
+  SELECT id, name, email, created, profile_picture_path, verified, totp_enabled FROM users
+  WHERE email = ($1)
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.QueryRow(ctx, statement, email).Scan(
+		&user.ID,
+		&user.UserName,
+		&user.Email,
+		&user.Created,
+		&user.PicturePath,
+		&user.Verified,
+		&user.TOTPEnabled,
+	)
+	if err != nil {
+		return nil, err
+	}
+	um.SetUserRole(user)
+
+	return user, nil
+}
+
+// Returns the user with the email only if it's the email they verified,
+// ErrRecordNotFound otherwise
+func (um *UserModel) GetUserByVerifiedEmail(email string) (*User, error) {
+	user := new(User)
+
+	statement := `
+  SELECT id, name, email, created, profile_picture_path, verified, totp_enabled FROM users
+  WHERE email = ($1) AND verified AND verified_email = email
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.QueryRow(ctx, statement, email).Scan(
+		&user.ID,
+		&user.UserName,
+		&user.Email,
+		&user.Created,
+		&user.PicturePath,
+		&user.Verified,
+		&user.TOTPEnabled,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, err
+	}
+	um.SetUserRole(user)
+
+	return user, nil
+}
+
 func (um *UserModel) SetID(user *User) {
 	selectStatement := `SELECT id, name FROM users WHERE email = $1`
 
@@ -158,26 +277,66 @@ func (um *UserModel) SetID(user *User) {
 	}
 }
 
-// Sets the role of the user (admin or not)
+// Sets the roles and permissions of the user
 func (um *UserModel) SetUserRole(user *User) {
-	selectAdmin := `
-  SELECT users.id FROM users
-  JOIN admin_users 
-  ON admin_users.user_id = users.id
-  WHERE users.email = $1
+	selectRoles := `
+  SELECT
+    COALESCE(array_agg(DISTINCT roles.name) FILTER (WHERE roles.name IS NOT NULL), '{}'),
+    COALESCE(array_agg(DISTINCT permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+  FROM user_roles
+  JOIN roles
+  ON roles.id = user_roles.role_id
+  LEFT JOIN role_permissions
+  ON role_permissions.role_id = roles.id
+  LEFT JOIN permissions
+  ON permissions.id = role_permissions.permission_id
+  WHERE user_roles.user_id = $1
   `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := um.DB.QueryRow(ctx, selectAdmin, user.Email).Scan(&user.ID)
+	err := um.DB.QueryRow(ctx, selectRoles, user.ID).Scan(&user.Roles, &user.Permissions)
 	if err != nil {
-		fmt.Println("ALKISDASKDJ", err)
-		user.IsAdmin = false
-		return
+		fmt.Println("ERROR", err)
+		user.Roles = nil
+		user.Permissions = nil
 	}
 
-	user.IsAdmin = true
+	user.IsAdmin = slices.Contains(user.Roles, RoleAdmin)
+}
+
+// Looks up whether the user still exists along with their current permissions,
+// used to check tokens against the current state of the account
+func (um *UserModel) GetAuthStatus(id int) (exists bool, isAdmin bool, permissions []string, err error) {
+	statement := `
+  SELECT
+    COALESCE(bool_or(roles.name = $2), false),
+    COALESCE(array_agg(DISTINCT permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+  FROM users
+  LEFT JOIN user_roles
+  ON user_roles.user_id = users.id
+  LEFT JOIN roles
+  ON roles.id = user_roles.role_id
+  LEFT JOIN role_permissions
+  ON role_permissions.role_id = roles.id
+  LEFT JOIN permissions
+  ON permissions.id = role_permissions.permission_id
+  WHERE users.id = $1
+  GROUP BY users.id
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = um.DB.QueryRow(ctx, statement, id, RoleAdmin).Scan(&isAdmin, &permissions)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, false, nil, nil
+		}
+		return false, false, nil, err
+	}
+
+	return true, isAdmin, permissions, nil
 }
 
 func (um *UserModel) ResetPicture(userName string) error {
@@ -197,22 +356,78 @@ func (um *UserModel) ResetPicture(userName string) error {
 	return nil
 }
 
-func (um *UserModel) ValidateLogin(user *User) error {
+// Checks the email and password, failed attempts are counted against the
+// account and the ip so passwords can't be guessed forever
+func (um *UserModel) ValidateLogin(user *User, ip string) error {
+	err := um.checkIPThrottle(ip)
+	if err != nil {
+		return err
+	}
+
 	hashedPassword := um.getHashedPassword(user)
 	statement := `
-  SELECT name FROM users
+  SELECT id, name, verified, totp_enabled, locked_until FROM users
   WHERE email = ($1)
   `
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := um.DB.QueryRow(ctx, statement, user.Email).Scan(&user.UserName)
+	err = um.DB.QueryRow(ctx, statement, user.Email).Scan(&user.ID, &user.UserName, &user.Verified, &user.TOTPEnabled, &user.LockedUntil)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			hasher.Verify(user.UnhashedPassword, dummyPasswordHash)
+			if err := um.recordLoginAttempt(nil, user.Email, ip, false); err != nil {
+				return err
+			}
+		}
 		return err
 	}
 
-	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(user.UnhashedPassword))
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		if err := um.recordLoginAttempt(&user.ID, user.Email, ip, false); err != nil {
+			return err
+		}
+		return ErrAccountLocked
+	}
+
+	match, err := hasher.Verify(user.UnhashedPassword, string(hashedPassword))
+	if err != nil || !match {
+		return um.registerFailedLogin(user, ip)
+	}
+
+	err = um.registerSuccessfulLogin(user, ip)
+	if err != nil {
+		return err
+	}
+
+	// This is the only time we have the plain text password,
+	// so hashes made with old settings get upgraded here
+	if hasher.NeedsRehash(string(hashedPassword)) {
+		err = um.rehashPassword(user.ID, user.UnhashedPassword, hashedPassword)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only checked after the password so we don't leak which emails are unverified
+	if !user.Verified {
+		return ErrUserNotVerified
+	}
+
+	return nil
+}
+
+func (um *UserModel) SetVerified(id int) error {
+	statement := `
+  UPDATE users
+  SET verified = true, verified_email = email
+  WHERE id = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := um.DB.Exec(ctx, statement, id)
 	if err != nil {
 		return err
 	}
@@ -243,25 +458,118 @@ func (um *UserModel) UpdatePicture(user *User) error {
 	return nil
 }
 
+// Changes the name and email of the user, empty ones are left as they are.
+// A new email has to be verified again, user.Verified is set to whether it still is
 func (um *UserModel) UpdateUser(user *User) error {
-	updateName := `UPDATE users SET name = $1 WHERE id = $2`
-	updateEmail := `UPDATE users SET email = $1 WHERE id = $2`
+	statement := `
+  UPDATE users
+  SET name = CASE WHEN $1 = '' THEN name ELSE $1 END,
+  email = CASE WHEN $2 = '' THEN email ELSE $2::citext END,
+  verified = verified AND ($2 = '' OR email = $2::citext)
+  WHERE id = $3
+  RETURNING name, email, verified
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := um.DB.QueryRow(ctx, statement, user.UserName, user.Email, user.ID).Scan(&user.UserName, &user.Email, &user.Verified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+
+		var pgerr *pgconn.PgError
+		if errors.As(err, &pgerr) && pgerr.Code == "23505" {
+			switch pgerr.ConstraintName {
+			case "users_name_key":
+				return ErrDuplicateUserName
+			case "users_email_key":
+				return ErrDuplicateEmail
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (um *UserModel) UpdatePassword(id int, password string) error {
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	statement := `
+  UPDATE users
+  SET hashed_password = $1, version = version + 1
+  WHERE id = $2
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = um.DB.Exec(ctx, statement, []byte(hashedPassword), id)
+	if err != nil {
+		return err
+	}
 
-	batch := &pgx.Batch{}
+	return nil
+}
 
-	if user.Email != "" {
-		batch.Queue(updateEmail, user.Email, user.ID)
+// Returns ErrIncorrectPassword if the password does not match the user's. Wrong
+// passwords count towards the same lockout as failed logins so a stolen token
+// can't be used to guess the password, ErrAccountLocked is returned while it's locked
+// with user.LockedUntil set
+func (um *UserModel) CheckPassword(user *User, password, ip string) error {
+	err := um.checkIPThrottle(ip)
+	if err != nil {
+		return err
 	}
 
-	if user.UserName != "" {
-		batch.Queue(updateName, user.UserName, user.ID)
+	statement := `
+  SELECT email, hashed_password, locked_until FROM users
+  WHERE id = $1
+  `
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var hashedPassword []byte
+	err = um.DB.QueryRow(ctx, statement, user.ID).Scan(&user.Email, &hashedPassword, &user.LockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		if err := um.recordLoginAttempt(&user.ID, user.Email, ip, false); err != nil {
+			return err
+		}
+		return ErrAccountLocked
+	}
+
+	match, err := hasher.Verify(password, string(hashedPassword))
+	if err != nil || !match {
+		return um.registerFailedLogin(user, ip)
+	}
+
+	return um.registerSuccessfulLogin(user, ip)
+}
+
+// Replaces the stored hash with one made with the current settings, nothing
+// happens if the password was changed in the meantime
+func (um *UserModel) rehashPassword(id int, password string, oldHash []byte) error {
+	newHash, err := hasher.Hash(password)
+	if err != nil {
+		return err
 	}
 
+	statement := `
+  UPDATE users
+  SET hashed_password = $1
+  WHERE id = $2 AND hashed_password = $3
+  `
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	br := um.DB.SendBatch(ctx, batch)
-	_, err := br.Exec()
+	_, err = um.DB.Exec(ctx, statement, []byte(newHash), id, oldHash)
 	if err != nil {
 		return err
 	}
@@ -285,3 +593,107 @@ func (um *UserModel) getHashedPassword(user *User) []byte {
 
 	return hashedPassword
 }
+
+// What the user list can be narrowed down by, zero values don't filter anything
+type UserFilters struct {
+	// Part of the name or email
+	Search        string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Admin         *bool
+	// Only users who can see the category, the same way GetAllActive decides it
+	CategoryID *int
+}
+
+func (um *UserModel) GetAll(userFilters UserFilters, filters Filters) ([]*User, Metadata, error) {
+	keyset, keysetArgs, err := filters.keysetCondition(7)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	statement := fmt.Sprintf(`
+  SELECT %s, id, name, email, created, profile_picture_path, verified, totp_enabled, roles FROM (
+    SELECT users.*,
+      COALESCE((
+        SELECT array_agg(roles.name ORDER BY roles.name) FROM user_roles
+        JOIN roles
+        ON roles.id = user_roles.role_id
+        WHERE user_roles.user_id = users.id
+      ), '{}') AS roles
+    FROM users
+  ) AS users
+  WHERE ($1 = '' OR strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0)
+  AND ($2::timestamptz IS NULL OR created >= $2)
+  AND ($3::timestamptz IS NULL OR created < $3)
+  AND ($4::boolean IS NULL OR ($5 = ANY(roles)) = $4)
+  AND ($6::bigint IS NULL OR EXISTS(
+    WITH RECURSIVE %s
+    SELECT 1 FROM visible
+    WHERE id = $6
+  ))
+  AND %s
+  ORDER BY %s
+  %s`, filters.totalRecordsColumn(), visibleCategories("users.id"), keyset, filters.orderBy(), filters.limitOffset())
+
+	args := []any{
+		userFilters.Search,
+		userFilters.CreatedAfter,
+		userFilters.CreatedBefore,
+		userFilters.Admin,
+		RoleAdmin,
+		userFilters.CategoryID,
+	}
+	args = append(args, keysetArgs...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := um.DB.Query(ctx, statement, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.UserName,
+			&user.Email,
+			&user.Created,
+			&user.PicturePath,
+			&user.Verified,
+			&user.TOTPEnabled,
+			&user.Roles,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		user.IsAdmin = slices.Contains(user.Roles, RoleAdmin)
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	users, metadata := paginate(filters, users, totalRecords, func(user *User, column string) any {
+		switch column {
+		case "name":
+			return user.UserName
+		case "email":
+			return user.Email
+		case "created":
+			return user.Created
+		}
+		return user.ID
+	})
+
+	return users, metadata, nil
+}
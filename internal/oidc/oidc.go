@@ -0,0 +1,302 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pelletier/go-toml"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown OIDC provider")
+	ErrInvalidIDToken  = errors.New("invalid ID token")
+)
+
+// Settings of one provider as written in the providers file
+type ProviderConfig struct {
+	Issuer       string   `toml:"issuer"`
+	ClientID     string   `toml:"clientID"`
+	ClientSecret string   `toml:"clientSecret"`
+	RedirectURL  string   `toml:"redirectURL"`
+	Scopes       []string `toml:"scopes"`
+
+	// Links the identity to an existing user with the same email,
+	// only enable it for providers that verify the emails they hand out
+	LinkByEmail bool `toml:"linkByEmail"`
+}
+
+// The parts of the provider's discovery document we use
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// The user the provider vouches for after a successful login
+type Identity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type Provider struct {
+	Name string
+	ProviderConfig
+
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      *keySet
+}
+
+// Reads the providers from a TOML file with one table per provider,
+// environment variables in the file are expanded so secrets don't have to live in it
+func LoadProviders(path string) (map[string]*Provider, error) {
+	providers := map[string]*Provider{}
+	if path == "" {
+		return providers, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := map[string]ProviderConfig{}
+	err = toml.Unmarshal([]byte(os.ExpandEnv(string(data))), &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, config := range configs {
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs an issuer, clientID and redirectURL", name)
+		}
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"openid", "email", "profile"}
+		}
+
+		providers[name] = &Provider{
+			Name:           name,
+			ProviderConfig: config,
+			client:         &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+
+	return providers, nil
+}
+
+// Fetches the discovery document the first time it's needed,
+// a failed fetch is retried on the next login
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+
+	document := &discoveryDocument{}
+	err := p.getJSON(ctx, discoveryURL, document)
+	if err != nil {
+		return nil, err
+	}
+
+	if document.Issuer != p.Issuer {
+		return nil, fmt.Errorf("OIDC provider %q reports issuer %q instead of %q", p.Name, document.Issuer, p.Issuer)
+	}
+	if document.AuthorizationEndpoint == "" || document.TokenEndpoint == "" || document.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider %q has an incomplete discovery document", p.Name)
+	}
+
+	p.discovery = document
+	p.keys = &keySet{uri: document.JWKSURI, provider: p}
+
+	return document, nil
+}
+
+// Builds the URL of the provider's login page the user gets redirected to
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	document, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(document.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return document.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchanges the authorization code for the provider's tokens
+// and returns the identity from the verified ID token
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	document, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, document.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	tokens := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC provider %q sent an unreadable token response: %w", p.Name, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC provider %q rejected the code: %s %s", p.Name, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("OIDC provider %q did not return an ID token", p.Name)
+	}
+
+	return p.verifyIDToken(ctx, document, tokens.IDToken, nonce)
+}
+
+// Claims of the ID token, email_verified is a string with some providers
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, document *discoveryDocument, rawToken, nonce string) (*Identity, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.get(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(document.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if claims.ExpiresAt == nil || claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing exp or sub", ErrInvalidIDToken)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	emailVerified := false
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		emailVerified = verified
+	case string:
+		emailVerified = verified == "true"
+	}
+
+	return &Identity{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     emailVerified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, target string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", target, response.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v)
+}
+
+// Random value used for the PKCE code verifier and the nonce
+func RandomString() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// The S256 PKCE challenge sent with the authorization request
+func CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -3,27 +3,62 @@ package server
 import (
 	"Sadeem-RestAPI/internal/auth"
 	"Sadeem-RestAPI/internal/models"
+	"Sadeem-RestAPI/internal/oidc"
 	"Sadeem-RestAPI/internal/translation"
 	"Sadeem-RestAPI/internal/validation"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
-	"github.com/go-playground/validator"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/labstack/echo/v4"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"golang.org/x/text/language"
 )
 
-var Validator = &validation.CustomValidator{V: validator.New()}
+var Validator = validation.New()
 
 // pictureDir = os.Getenv("PICTURE_DIR")
 
+// Base URL of the frontend, used to build the links we email to users
+var appURL = os.Getenv("APP_URL")
+
+// Locale of the names and descriptions in the categories table, the other locales come from their translations
+var defaultCategoryLocale = categoryLocaleFromEnv()
+
+const (
+	passwordResetTokenTTL = time.Hour
+	verificationTokenTTL  = 72 * time.Hour
+
+	defaultApiKeyTTLDays = 90
+
+	// Limits of the page and pageSize query parameters of the list endpoints
+	defaultPageSize = 20
+	maxPageSize     = 100
+	maxPage         = 1_000_000
+
+	// How long the user has to finish logging in at an OIDC provider
+	oidcLoginStateTTL = 10 * time.Minute
+	oidcStateCookie   = "oidc_state"
+
+	// Names taken from providers are cut down to this many characters
+	maxOIDCUserNameLength = 32
+)
+
 func (s *Server) registerUser(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
@@ -55,78 +90,21 @@ func (s *Server) registerUser(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, msg)
 	}
 
-	return c.JSON(http.StatusCreated, fmt.Sprintf("User %s Registered Successfully", user.UserName))
-}
-
-func (s *Server) updateUser(c echo.Context) error {
-	lang := c.Request().Header.Get("Accept-Language")
-	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
-
-	if !ValidTokenForParam(c) {
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorUnAuthorized",
-		})
-
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
-	}
-
-	type inputStruct struct {
-		Name     string `json:"userName,omitempty"`
-		Email    string `json:"email,omitempty" validate:"email"`
-		Password string `json:"password" validate:"required"`
-	}
-
-	input := &inputStruct{}
-
-	err := c.Bind(input)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": err})
-	}
-
-	if msgs, err := Validator.Validate(input, lang); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": msgs})
-	}
-
-	id, err := getIDFromParam(c)
-	if err != nil {
-		c.Logger().Error(err)
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorGeniricBadRequest",
-		})
-
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
-	}
-
-	user := &models.User{
-		ID:       id,
-		UserName: input.Name,
-		Email:    input.Email,
-	}
-
-	err = models.Models.User.UpdateUser(user)
+	err := s.sendVerificationEmail(c, localizer, user)
 	if err != nil {
 		c.Logger().Error(err)
-		return err
 	}
 
-	message := localizer.MustLocalize(&i18n.LocalizeConfig{
-		DefaultMessage: &i18n.Message{
-			ID:    "UserUpdateSuccess",
-			Other: "User info updated successfully",
-		},
-	})
-
-	return c.JSON(http.StatusOK, echo.Map{"message": message})
+	return c.JSON(http.StatusCreated, fmt.Sprintf("User %s Registered Successfully", user.UserName))
 }
 
-func (s *Server) login(c echo.Context) error {
+// Verifies the user's email using the token we sent them on registration
+func (s *Server) verifyUser(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
 	type input struct {
-		Email    string `json:"email" validate:"required"`
-		Password string `json:"password" validate:"required"`
+		Token string `json:"token" validate:"required"`
 	}
 
 	i := &input{}
@@ -139,411 +117,3133 @@ func (s *Server) login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
 	}
 
-	user := &models.User{
-		Email:            i.Email,
-		UnhashedPassword: i.Password,
-	}
-
-	err := models.Models.User.ValidateLogin(user)
+	userID, err := models.Models.Token.Use(i.Token, models.ScopeVerification)
 	if err != nil {
-		c.Logger().Error(err, user)
+		if errors.Is(err, models.ErrInvalidToken) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorInvalidVerificationToken",
+					Other: "This verification link is invalid or has expired",
+				},
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			DefaultMessage: &i18n.Message{
-				ID:    "ErrorFailedLogin",
-				Other: "Username or Password incorrect",
-			},
+			MessageID: "ErrorGenericInternal",
 		})
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
-	models.Models.User.SetUserRole(user)
-	// models.Models.User.SetID(user)
-	c.Logger().Error(user)
-
-	token, err := auth.CreateJwtToken(user)
+	err = models.Models.User.SetVerified(userID)
 	if err != nil {
-		c.Logger().Error(err, user)
+		c.Logger().Error(err)
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			MessageID: "ErrorGenericInternal",
 		})
-		c.Logger().Error(err)
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
-	return c.JSON(http.StatusOK, token)
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessUserVerified",
+			Other: "Email verified successfully, you can now login",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
 }
 
-func (s *Server) deleteProfilePicture(c echo.Context) error {
+// Admin only, sends a new verification email to the user
+func (s *Server) resendVerification(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
-	if !ValidTokenForParam(c) {
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorUnAuthorized",
+			MessageID: "ErrorUserNotExists",
 		})
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
 	}
 
-	user := c.Param("name")
+	if user.Verified {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorUserAlreadyVerified",
+				Other: "This user has already verified their email",
+			},
+		})
+		return c.JSON(http.StatusConflict, echo.Map{"error": message})
+	}
 
-	err := models.Models.User.ResetPicture(user)
+	err = s.sendVerificationEmail(c, localizer, user)
 	if err != nil {
+		c.Logger().Error(err)
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			MessageID: "ErrorGenericInternal",
 		})
-		return c.JSON(http.StatusOK, echo.Map{"message": message})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
 	message := localizer.MustLocalize(&i18n.LocalizeConfig{
 		DefaultMessage: &i18n.Message{
-			ID:    "SuccessUserUpdate",
-			Other: "User info update successfully",
+			ID:    "SuccessVerificationSent",
+			Other: "Verification email sent",
 		},
 	})
-
-	return c.JSON(http.StatusOK, echo.Map{"message": message})
+	return c.JSON(http.StatusAccepted, echo.Map{"message": message})
 }
 
-func (s *Server) deleteUser(c echo.Context) error {
+// Admin only, marks the user as verified without going through the email
+func (s *Server) manuallyVerifyUser(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
-	if !ValidTokenForParam(c) {
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorUnAuthorized",
+			MessageID: "ErrorUserNotExists",
 		})
-		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
 	}
 
-	name := c.Param("name")
-
-	err := models.Models.User.DeleteUser(name)
+	err = models.Models.User.SetVerified(user.ID)
 	if err != nil {
 		c.Logger().Error(err)
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			MessageID: "ErrorGenericInternal",
 		})
-		return c.JSON(http.StatusOK, echo.Map{"message": message})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
 	message := localizer.MustLocalize(&i18n.LocalizeConfig{
-		DefaultMessage: &i18n.Message{
-			ID:    "SuccessUserDelete",
-			Other: "User deleted successfully",
-		},
+		MessageID: "SuccessUserVerified",
 	})
 	return c.JSON(http.StatusOK, echo.Map{"message": message})
 }
 
-func (s *Server) setCategoryVisibilityOnUser(c echo.Context) error {
+func (s *Server) updateUser(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
 	type inputStruct struct {
-		UserName   string   `json:"userName" validate:"required"`
-		Categories []string `json:"categories" validate:"required"`
-		Activate   bool     `json:"activate" validate:"required"`
+		Name     string `json:"userName,omitempty"`
+		Email    string `json:"email,omitempty" validate:"omitempty,email"`
+		Password string `json:"password" validate:"required"`
 	}
 
 	input := &inputStruct{}
+
 	err := c.Bind(input)
 	if err != nil {
 		c.Logger().Error(err)
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			DefaultMessage: &i18n.Message{
-				ID:    "ErrorGenericBadRequest",
-				Other: "Your request doe not match the specified format, please fix and try again",
-			},
-		})
-		return c.JSON(http.StatusBadRequest, message)
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err})
 	}
 
-	err = models.Models.Catagory.EditOnUser(input.UserName, input.Categories, input.Activate)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	if msgs, err := Validator.Validate(input, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": msgs})
 	}
 
-	return c.JSON(http.StatusOK, nil)
-}
+	id, err := getIDFromParam(c)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
 
-func (s *Server) updateProfilePicture(c echo.Context) error {
-	lang := c.Request().Header.Get("Accept-Language")
-	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
 
-	if !ValidTokenForParam(c) {
+	// This route is addressed by ID so ValidTokenForParam can't be used
+	if id != getIDFromToken(c) && !hasPermission(c, models.PermissionUsersWrite) {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			MessageID: "ErrorUnAuthorized",
 		})
+
 		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
 	}
 
-	userName := c.Param("name")
-
-	pictureDir := os.Getenv("PICTURE_DIR")
-
-	var message string
-	defer c.Request().Body.Close()
-	byte, err := io.ReadAll(c.Request().Body)
+	// Whoever makes the change has to confirm their own password,
+	// a stolen token alone is not enough to take over the account's email
+	requester := &models.User{ID: getIDFromToken(c)}
+	err = models.Models.User.CheckPassword(requester, input.Password, c.RealIP())
 	if err != nil {
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			DefaultMessage: &i18n.Message{
-				ID:    "CouldNotReadImage",
-				Other: "Could not proccess your image, plasea try again with a new image",
-			},
-		})
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		return passwordCheckFailed(c, localizer, requester, err)
 	}
 
-	mimeType := http.DetectContentType(byte)
-
-	if mimeType != "image/jpeg" && mimeType != "image/png" {
-		message = localizer.MustLocalize(
-			&i18n.LocalizeConfig{
-				DefaultMessage: &i18n.Message{
-					ID:    "NotPngOrJpeg",
-					Other: "Profile Picture must be a PNG or a JPG",
-				},
-			})
-
-		return c.JSON(http.StatusBadRequest, echo.Map{"message": message})
+	user := &models.User{
+		ID:       id,
+		UserName: input.Name,
+		Email:    input.Email,
 	}
 
-	_, fileType, _ := strings.Cut(mimeType, "/")
-	fileName := fmt.Sprintf("user_%s-profile_picture.%s", userName, fileType)
-	filePath := path.Join(pictureDir, fileName)
-
-	message = localizer.MustLocalize(&i18n.LocalizeConfig{
-		DefaultMessage: &i18n.Message{
-			ID:    "ErrorGenericInternal",
-			Other: "We encountred an error proccessing you're request, please try again later",
-		},
-	})
-
-	_, err = os.Create(filePath)
+	err = models.Models.User.UpdateUser(user)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
-	}
+		switch {
+		case errors.Is(err, models.ErrDuplicateUserName), errors.Is(err, models.ErrDuplicateEmail):
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorDuplicateEmailOrUsername",
+			})
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		case errors.Is(err, models.ErrRecordNotFound):
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorUserNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
 
-	err = os.WriteFile(filePath, byte, os.ModeAppend)
-	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
-	user := &models.User{
-		UserName:    userName,
-		PicturePath: fileName,
-	}
-
-	err = models.Models.User.UpdatePicture(user)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": err})
+	// Whoever changed the email has to prove they own the new one
+	if input.Email != "" && !user.Verified {
+		err = s.sendVerificationEmail(c, localizer, user)
+		if err != nil {
+			c.Logger().Error(err)
+		}
 	}
 
-	message = localizer.MustLocalize(
-		&i18n.LocalizeConfig{
-			DefaultMessage: &i18n.Message{
-				ID:    "SuccessUpdateProfilePicture",
-				Other: "Profile Picture Updated Successfully",
-			},
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "UserUpdateSuccess",
+			Other: "User info updated successfully",
 		},
-	)
+	})
 
 	return c.JSON(http.StatusOK, echo.Map{"message": message})
 }
 
-func (s *Server) getUserByUserName(c echo.Context) error {
+// Changes the password of the user, the current password has to be
+// confirmed and every other session of the user is logged out
+func (s *Server) changePassword(c echo.Context) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
-	userName := c.Param("name")
-	user, err := models.Models.User.GetUserByName(userName)
-	if err != nil {
+	if !isTokenUser(c) || isApiKey(c) {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorUserNotExists",
+			MessageID: "ErrorUnAuthorized",
 		})
 		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
 	}
 
-	if !ValidTokenForParam(c) {
-		return c.JSON(http.StatusUnauthorized, echo.Map{"user": echo.Map{"userName": user.UserName, "email": user.Email}})
+	type inputStruct struct {
+		CurrentPassword string `json:"currentPassword" validate:"required"`
+		NewPassword     string `json:"newPassword" validate:"required,password"`
+
+		// Not sent by the client, only here so the password policy can check against them
+		UserName string `json:"-"`
+		Email    string `json:"-"`
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{"message": user})
+	input := &inputStruct{}
+
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	userID := getIDFromToken(c)
+
+	user, err := models.Models.User.GetUserByID(userID)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	input.UserName = user.UserName
+	input.Email = user.Email
+
+	if msgs, err := Validator.Validate(input, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	err = models.Models.User.CheckPassword(user, input.CurrentPassword, c.RealIP())
+	if err != nil {
+		return passwordCheckFailed(c, localizer, user, err)
+	}
+
+	err = models.Models.User.UpdatePassword(userID, input.NewPassword)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.Session.DeleteAllExcept(userID, getSessionIDFromToken(c))
+	if err != nil {
+		c.Logger().Error(err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessPasswordChanged",
+			Other: "Password changed successfully, you have been logged out on your other devices",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) login(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Email    string `json:"email" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	user := &models.User{
+		Email:            i.Email,
+		UnhashedPassword: i.Password,
+	}
+
+	err := models.Models.User.ValidateLogin(user, c.RealIP())
+	if errors.Is(err, models.ErrTooManyAttempts) {
+		return tooManyAttempts(c, localizer)
+	}
+	if errors.Is(err, models.ErrAccountLocked) {
+		return accountLocked(c, localizer, *user.LockedUntil)
+	}
+	if errors.Is(err, models.ErrUserNotVerified) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorUserNotVerified",
+				Other: "Please verify your email before logging in, check your inbox for the verification link",
+			},
+		})
+		return c.JSON(http.StatusForbidden, echo.Map{"error": message})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorFailedLogin",
+				Other: "Username or Password incorrect",
+			},
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	models.Models.User.SetUserRole(user)
+
+	return startSession(c, localizer, user)
+}
+
+// Second step of the login for users with 2FA, exchanges the challenge token
+// and a TOTP or recovery code for the real tokens
+func (s *Server) loginTwoFactor(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		ChallengeToken string `json:"challengeToken" validate:"required"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	invalidMessage := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorInvalidTwoFactorCode",
+			Other: "The code is invalid or has expired",
+		},
+	})
+
+	userID, err := auth.UseChallengeToken(i.ChallengeToken)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": invalidMessage})
+	}
+
+	if i.RecoveryCode != "" {
+		err = models.Models.User.UseRecoveryCode(userID, i.RecoveryCode)
+	} else {
+		err = verifyTOTPCode(userID, i.Code)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": invalidMessage})
+	}
+
+	user, err := models.Models.User.GetUserByID(userID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": invalidMessage})
+	}
+
+	tokens, err := auth.NewSession(user, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Lists the names of the configured login providers
+func (s *Server) getOIDCProviders(c echo.Context) error {
+	providers := make([]string, 0, len(s.oidcProviders))
+	for name := range s.oidcProviders {
+		providers = append(providers, name)
+	}
+	slices.Sort(providers)
+
+	return c.JSON(http.StatusOK, echo.Map{"providers": providers})
+}
+
+// Sends the user to the provider's login page, the state, nonce and PKCE verifier
+// are stored so the callback can check the response belongs to this login
+func (s *Server) oidcLogin(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	provider, ok := s.oidcProviders[c.Param("provider")]
+	if !ok {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorUnknownLoginProvider",
+				Other: "Unknown login provider",
+			},
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	codeVerifier, err := oidc.RandomString()
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	state, err := models.Models.Identity.NewLoginState(provider.Name, codeVerifier, nonce, oidcLoginStateTTL)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	authURL, err := provider.AuthCodeURL(c.Request().Context(), state, nonce, codeVerifier)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorLoginProviderUnavailable",
+				Other: "The login provider could not be reached, please try again later",
+			},
+		})
+		return c.JSON(http.StatusBadGateway, echo.Map{"error": message})
+	}
+
+	// The state is also kept in a cookie so a login started in someone else's browser can't be finished in ours
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// Where the provider sends the user back to, exchanges the code for the user's identity
+// and logs in the user it's linked to, creating one on their first login
+func (s *Server) oidcCallback(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	provider, ok := s.oidcProviders[c.Param("provider")]
+	if !ok {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnknownLoginProvider",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	failedMessage := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorProviderLoginFailed",
+			Other: "Logging in with the provider failed",
+		},
+	})
+	invalidStateMessage := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorInvalidLoginState",
+			Other: "The login request is invalid or has expired, please try again",
+		},
+	})
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		c.Logger().Error(providerError, " ", c.QueryParam("error_description"))
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": failedMessage})
+	}
+
+	state := c.QueryParam("state")
+	code := c.QueryParam("code")
+
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || code == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": invalidStateMessage})
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/api/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	codeVerifier, nonce, err := models.Models.Identity.UseLoginState(state, provider.Name)
+	if errors.Is(err, models.ErrInvalidLoginState) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": invalidStateMessage})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	identity, err := provider.Exchange(c.Request().Context(), code, codeVerifier, nonce)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": failedMessage})
+	}
+
+	user, err := models.Models.Identity.GetUser(provider.Name, identity.Subject)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		user, err = linkOrProvisionUser(provider, identity)
+	}
+	if errors.Is(err, errProviderEmailNotVerified) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorProviderEmailNotVerified",
+				Other: "The login provider has not verified your email",
+			},
+		})
+		return c.JSON(http.StatusForbidden, echo.Map{"error": message})
+	}
+	if errors.Is(err, models.ErrDuplicateEmail) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorProviderEmailTaken",
+				Other: "An account with this email already exists, please login with your password",
+			},
+		})
+		return c.JSON(http.StatusConflict, echo.Map{"error": message})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return startSession(c, localizer, user)
+}
+
+// Generates a new TOTP secret for the user, 2FA is only turned
+// on after they confirm it with a code
+func (s *Server) enrollTwoFactor(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !isTokenUser(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	userID := getIDFromToken(c)
+
+	_, enabled, err := models.Models.User.GetTOTP(userID)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	if enabled {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorTwoFactorAlreadyEnabled",
+				Other: "Two factor authentication is already enabled",
+			},
+		})
+		return c.JSON(http.StatusConflict, echo.Map{"error": message})
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.User.SetTOTPSecret(userID, secret)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"secret": secret,
+		"uri":    auth.TOTPProvisioningURI(c.Param("name"), secret),
+	})
+}
+
+// Turns on 2FA once the user proves their authenticator works,
+// the recovery codes are only ever shown here
+func (s *Server) confirmTwoFactor(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !isTokenUser(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	type input struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	userID := getIDFromToken(c)
+
+	err := verifyTOTPCode(userID, i.Code)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorInvalidTwoFactorCode",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(10)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.User.EnableTOTP(userID, recoveryCodes)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessTwoFactorEnabled",
+			Other: "Two factor authentication enabled, keep your recovery codes somewhere safe",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message, "recoveryCodes": recoveryCodes})
+}
+
+// Users need a valid code to turn off their own 2FA,
+// admins can turn it off for users that lost their authenticator
+func (s *Server) disableTwoFactor(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	if isTokenUser(c) {
+		type input struct {
+			Code string `json:"code" validate:"required"`
+		}
+
+		i := &input{}
+
+		if err := c.Bind(i); err != nil {
+			return c.JSON(http.StatusBadRequest, err.Error())
+		}
+
+		if msgs, err := Validator.Validate(i, lang); err != nil {
+			return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+		}
+
+		err = verifyTOTPCode(user.ID, i.Code)
+		if err != nil {
+			c.Logger().Error(err)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorInvalidTwoFactorCode",
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+	}
+
+	err = models.Models.User.DisableTOTP(user.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessTwoFactorDisabled",
+			Other: "Two factor authentication disabled",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) refreshToken(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		RefreshToken string `json:"refreshToken" validate:"required"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	tokens, err := auth.RefreshSession(i.RefreshToken, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorInvalidRefreshToken",
+					Other: "Your session has expired, please login again",
+				},
+			})
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Publishes the public keys our tokens are signed with so other services can verify them
+func (s *Server) getJWKS(c echo.Context) error {
+	jwks, err := auth.PublicKeys()
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.ErrInternalServerError
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(http.StatusOK, echo.Map{"keys": jwks})
+}
+
+func (s *Server) logout(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+
+	// Impersonation tokens share the staff member's session, only the token itself is revoked
+	if _, impersonated := claims["act"]; !impersonated {
+		err := models.Models.Session.Delete(getSessionIDFromToken(c), getIDFromToken(c))
+		if err != nil && !errors.Is(err, models.ErrRecordNotFound) {
+			c.Logger().Error(err)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorGenericInternal",
+			})
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+		}
+	}
+
+	// The session is gone but we also revoke the token itself
+	// so it shows up in the revocation list
+	tokenID, _ := claims["jti"].(string)
+	expiry, _ := claims.GetExpirationTime()
+	if tokenID != "" && expiry != nil {
+		err := models.Models.Revoked.Revoke(tokenID, expiry.Time)
+		if err != nil {
+			c.Logger().Error(err)
+		}
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessLogout",
+			Other: "Logged out successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Logs the user out of every device they are logged in on
+func (s *Server) logoutEverywhere(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	err := models.Models.Session.DeleteAllForUser(getIDFromToken(c))
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessLogoutEverywhere",
+			Other: "Logged out of all devices successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Lists the devices the user is logged in on
+func (s *Server) getSessions(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) && !hasPermission(c, models.PermissionUsersRead) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	sessions, err := models.Models.Session.GetAllForUser(user.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	currentSessionID := getSessionIDFromToken(c)
+	for _, session := range sessions {
+		session.Current = session.ID == currentSessionID
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"sessions": sessions})
+}
+
+// Ends one of the user's sessions, the device is logged out on its next request
+func (s *Server) deleteSession(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	id, err := getIDFromParam(c)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	err = models.Models.Session.Delete(int64(id), user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorSessionNotExists",
+					Other: "That session does not exist",
+				},
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessSessionDelete",
+			Other: "Session ended successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Emails the user a password reset link, we always respond the same way
+// so the endpoint can't be used to find out which emails are registered
+func (s *Server) forgotPassword(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessPasswordResetRequested",
+			Other: "If that email is registered you will receive a link to reset your password",
+		},
+	})
+
+	user, err := models.Models.User.GetUserByEmail(i.Email)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusAccepted, echo.Map{"message": message})
+	}
+
+	token, err := models.Models.Token.New(user.ID, passwordResetTokenTTL, models.ScopePasswordReset)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusAccepted, echo.Map{"message": message})
+	}
+
+	data := map[string]string{
+		"UserName": user.UserName,
+		"Token":    token,
+		"Link":     fmt.Sprintf("%s/reset-password?token=%s", appURL, token),
+	}
+
+	subject := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "EmailPasswordResetSubject",
+			Other: "Reset your password",
+		},
+	})
+	body := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "EmailPasswordResetBody",
+			Other: "Hi {{.UserName}}, use the following link to reset your password: {{.Link}} the link expires in one hour, if you did not ask for this you can ignore this email",
+		},
+		TemplateData: data,
+	})
+
+	s.sendEmail(c, user.Email, subject, body)
+
+	return c.JSON(http.StatusAccepted, echo.Map{"message": message})
+}
+
+func (s *Server) resetPassword(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required,password"`
+
+		// Not sent by the client, only here so the password policy can check against them
+		UserName string `json:"-"`
+		Email    string `json:"-"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	invalidTokenMessage := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorInvalidResetToken",
+			Other: "This password reset link is invalid or has expired",
+		},
+	})
+
+	// Only peeking at the token here, it's used up after the new password passes validation
+	userID, err := models.Models.Token.GetUserID(i.Token, models.ScopePasswordReset)
+	if err == nil {
+		user, err := models.Models.User.GetUserByID(userID)
+		if err == nil {
+			i.UserName = user.UserName
+			i.Email = user.Email
+		}
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	userID, err = models.Models.Token.Use(i.Token, models.ScopePasswordReset)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": invalidTokenMessage})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.User.UpdatePassword(userID, i.Password)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	// Whoever had the old password should not stay logged in
+	err = models.Models.Session.DeleteAllForUser(userID)
+	if err != nil {
+		c.Logger().Error(err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessPasswordReset",
+			Other: "Password changed successfully, you can now login with your new password",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) deleteProfilePicture(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user := c.Param("name")
+
+	err := models.Models.User.ResetPicture(user)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusOK, echo.Map{"message": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessUserUpdate",
+			Other: "User info update successfully",
+		},
+	})
+
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) deleteUser(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	name := c.Param("name")
+
+	err := models.Models.User.DeleteUser(name)
+	if errors.Is(err, models.ErrLastAdmin) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorLastAdmin",
+		})
+		return c.JSON(http.StatusConflict, echo.Map{"error": message})
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessUserDelete",
+			Other: "User deleted successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) setCategoryVisibilityOnUser(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type inputStruct struct {
+		UserName   string   `json:"userName" validate:"required"`
+		Categories []string `json:"categories" validate:"required"`
+		Activate   bool     `json:"activate" validate:"required"`
+
+		// Activating also shows everything under the categories, deactivating hides it
+		IncludeSubcategories bool `json:"includeSubcategories"`
+	}
+
+	input := &inputStruct{}
+	err := c.Bind(input)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorGenericBadRequest",
+				Other: "Your request doe not match the specified format, please fix and try again",
+			},
+		})
+		return c.JSON(http.StatusBadRequest, message)
+	}
+
+	categoryIDs, err := resolveCategories(input.Categories)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.Catagory.EditOnUser(input.UserName, categoryIDs, input.Activate, input.IncludeSubcategories)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, nil)
+}
+
+// Lifts the lockout of an account that had too many failed logins
+func (s *Server) unlockUser(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	err := models.Models.User.Unlock(c.Param("name"))
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorUserNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessUserUnlocked",
+			Other: "Account unlocked successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Lists the latest login attempts so brute force activity can be spotted
+func (s *Server) getLoginAttempts(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "created", "-id", "-created"}, "-created")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	failedOnly := c.QueryParam("failed") == "true"
+
+	attempts, metadata, err := models.Models.User.GetLoginAttempts(c.QueryParam("email"), c.QueryParam("ip"), failedOnly, filters)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"attempts": attempts, "metadata": metadata})
+}
+
+// Issues a short lived, read only token that lets a staff member see the API
+// exactly as the user does, only users without any roles can be impersonated
+func (s *Server) impersonateUser(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	// The token is bound to the staff member's session, API keys don't have one
+	if isApiKey(c) {
+		return echo.ErrForbidden
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	actorID := getIDFromToken(c)
+	if user.ID == actorID || len(user.Roles) > 0 {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorCannotImpersonate",
+				Other: "Only users without any roles can be impersonated",
+			},
+		})
+		return c.JSON(http.StatusForbidden, echo.Map{"error": message})
+	}
+
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	actorName, _ := claims["name"].(string)
+
+	token, expiry, err := auth.CreateImpersonationToken(user, actorID, actorName, getSessionIDFromToken(c))
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	// Not handing out the token without a trace of it
+	err = models.Models.Audit.Insert(&models.AuditEntry{
+		ActorID:   actorID,
+		ActorName: actorName,
+		UserID:    user.ID,
+		UserName:  user.UserName,
+		Action:    models.AuditImpersonationStart,
+		Method:    c.Request().Method,
+		Path:      c.Request().URL.RequestURI(),
+		Status:    http.StatusOK,
+		IP:        c.RealIP(),
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"accessToken":   token,
+		"expiry":        expiry,
+		"impersonating": user.UserName,
+	})
+}
+
+func (s *Server) getAuditLog(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "created", "-id", "-created"}, "-created")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	entries, metadata, err := models.Models.Audit.GetAll(c.QueryParam("actor"), c.QueryParam("user"), filters)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"entries": entries, "metadata": metadata})
+}
+
+func (s *Server) getRoles(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	roles, err := models.Models.Role.GetAll()
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"roles": roles})
+}
+
+func (s *Server) getAdmins(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	admins, err := models.Models.Role.GetUsersWithRole(models.RoleAdmin)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"admins": admins})
+}
+
+func (s *Server) promoteAdmin(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+
+	type inputStruct struct {
+		UserName string `json:"userName" validate:"required"`
+	}
+
+	input := &inputStruct{}
+
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(input, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	return changeRole(c, input.UserName, models.RoleAdmin, true)
+}
+
+func (s *Server) demoteAdmin(c echo.Context) error {
+	return changeRole(c, c.Param("name"), models.RoleAdmin, false)
+}
+
+func (s *Server) grantRole(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+
+	type inputStruct struct {
+		Role string `json:"role" validate:"required"`
+	}
+
+	input := &inputStruct{}
+
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(input, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	return changeRole(c, c.Param("name"), input.Role, true)
+}
+
+func (s *Server) revokeRole(c echo.Context) error {
+	return changeRole(c, c.Param("name"), c.Param("role"), false)
+}
+
+// Creates a personal API key, the key is only shown in this response
+func (s *Server) createApiKey(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	// Keys can only be made by the user themselves and not with another key
+	if !isTokenUser(c) || isApiKey(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	type inputStruct struct {
+		Name          string   `json:"name" validate:"required"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays" validate:"min=0,max=365"`
+	}
+
+	input := &inputStruct{}
+
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	if msgs, err := Validator.Validate(input, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	for _, scope := range input.Scopes {
+		if !hasPermission(c, scope) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorScopeNotAllowed",
+					Other: "You can not give a key a permission you do not have: {{.Scope}}",
+				},
+				TemplateData: map[string]string{"Scope": scope},
+			})
+			return c.JSON(http.StatusForbidden, echo.Map{"error": message})
+		}
+	}
+
+	if input.ExpiresInDays == 0 {
+		input.ExpiresInDays = defaultApiKeyTTLDays
+	}
+
+	key := &models.ApiKey{
+		UserID: getIDFromToken(c),
+		Name:   input.Name,
+		Scopes: input.Scopes,
+		Expiry: time.Now().AddDate(0, 0, input.ExpiresInDays),
+	}
+
+	plainText, err := models.Models.ApiKey.Insert(key)
+	if err != nil {
+		if pgerr, ok := err.(*pgconn.PgError); ok && pgerr.Code == "23505" {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorDuplicateApiKeyName",
+					Other: "You already have a key with that name",
+				},
+			})
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusCreated, echo.Map{"apiKey": key, "key": plainText})
+}
+
+func (s *Server) getApiKeys(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) && !hasPermission(c, models.PermissionUsersRead) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	keys, err := models.Models.ApiKey.GetAllForUser(user.ID)
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"apiKeys": keys})
+}
+
+func (s *Server) deleteApiKey(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	user, err := models.Models.User.GetUserByName(c.Param("name"))
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	}
+
+	id, err := getIDFromParam(c)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	err = models.Models.ApiKey.Delete(int64(id), user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorApiKeyNotExists",
+					Other: "That API key does not exist",
+				},
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessApiKeyDelete",
+			Other: "API key revoked successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) updateProfilePicture(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	if !ValidTokenForParam(c) {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUnAuthorized",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	userName := c.Param("name")
+
+	pictureDir := os.Getenv("PICTURE_DIR")
+
+	var message string
+	defer c.Request().Body.Close()
+	byte, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "CouldNotReadImage",
+				Other: "Could not proccess your image, plasea try again with a new image",
+			},
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	mimeType := http.DetectContentType(byte)
+
+	if mimeType != "image/jpeg" && mimeType != "image/png" {
+		message = localizer.MustLocalize(
+			&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "NotPngOrJpeg",
+					Other: "Profile Picture must be a PNG or a JPG",
+				},
+			})
+
+		return c.JSON(http.StatusBadRequest, echo.Map{"message": message})
+	}
+
+	_, fileType, _ := strings.Cut(mimeType, "/")
+	fileName := fmt.Sprintf("user_%s-profile_picture.%s", userName, fileType)
+	filePath := path.Join(pictureDir, fileName)
+
+	message = localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorGenericInternal",
+			Other: "We encountred an error proccessing you're request, please try again later",
+		},
+	})
+
+	_, err = os.Create(filePath)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = os.WriteFile(filePath, byte, os.ModeAppend)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	user := &models.User{
+		UserName:    userName,
+		PicturePath: fileName,
+	}
+
+	err = models.Models.User.UpdatePicture(user)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": err})
+	}
+
+	message = localizer.MustLocalize(
+		&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "SuccessUpdateProfilePicture",
+				Other: "Profile Picture Updated Successfully",
+			},
+		},
+	)
+
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Lists users page by page for staff, narrowed down by the query parameters
+func (s *Server) getUsers(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "name", "email", "created", "-id", "-name", "-email", "-created"}, "name")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	userFilters := models.UserFilters{
+		Search: strings.TrimSpace(c.QueryParam("search")),
+	}
+
+	dateParams := []struct {
+		name   string
+		target **time.Time
+	}{
+		{"createdAfter", &userFilters.CreatedAfter},
+		{"createdBefore", &userFilters.CreatedBefore},
+	}
+	for _, param := range dateParams {
+		value := c.QueryParam(param.name)
+		if value == "" {
+			continue
+		}
+
+		date, err := parseDate(value)
+		if err != nil {
+			return badQueryParam(c, localizer, param.name)
+		}
+		*param.target = &date
+	}
+
+	if value := c.QueryParam("admin"); value != "" {
+		admin, err := strconv.ParseBool(value)
+		if err != nil {
+			return badQueryParam(c, localizer, "admin")
+		}
+		userFilters.Admin = &admin
+	}
+
+	if ref := strings.TrimSpace(c.QueryParam("category")); ref != "" {
+		categoryID, err := models.Models.Catagory.Resolve(ref)
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return badQueryParam(c, localizer, "category")
+		}
+		if err != nil {
+			c.Logger().Error(err)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorGenericInternal",
+			})
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+		}
+		userFilters.CategoryID = &categoryID
+	}
+
+	users, metadata, err := models.Models.User.GetAll(userFilters, filters)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"users": users, "metadata": metadata})
+}
+
+func (s *Server) getUserByUserName(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	userName := c.Param("name")
+	user, err := models.Models.User.GetUserByName(userName)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
+	}
+
+	if !ValidTokenForParam(c) && !hasPermission(c, models.PermissionUsersRead) {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"user": echo.Map{"userName": user.UserName, "email": user.Email}})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"message": user})
+}
+
+func (s *Server) getAllCategories(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "name", "-id", "-name"}, "name")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	search := strings.TrimSpace(c.QueryParam("search"))
+	locales := categoryLocales(c)
+
+	var cats []*models.Catagory
+	var metadata models.Metadata
+	var err error
+	if hasPermission(c, models.PermissionCategoriesRead) {
+		cats, metadata, err = models.Models.Catagory.GetAll(search, locales, filters)
+	} else {
+		cats, metadata, err = models.Models.Catagory.GetAllActive(getIDFromToken(c), search, locales, filters)
+	}
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"categories": cats, "metadata": metadata})
+}
+
+// Returns the categories nested under their parents, users without
+// categories:read only get the part of the tree they can see
+func (s *Server) getCategoryTree(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	tree, err := models.Models.Catagory.GetTree(getIDFromToken(c), hasPermission(c, models.PermissionCategoriesRead), categoryLocales(c))
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"categories": tree})
+}
+
+// Moves the category and everything under it to another parent,
+// an empty parent makes it a top level category
+func (s *Server) moveCategory(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Parent string `json:"parent"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	var parentID *int
+	id, err := readCategoryParam(c)
+	if parent := strings.TrimSpace(i.Parent); err == nil && parent != "" {
+		parentID = new(int)
+		*parentID, err = models.Models.Catagory.Resolve(parent)
+	}
+	if err == nil {
+		err = models.Models.Catagory.Move(id, parentID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		case errors.Is(err, models.ErrCategoryCycle):
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorCategoryCycle",
+					Other: "A category can't be moved under itself or one of its subcategories",
+				},
+			})
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		default:
+			c.Logger().Error(err)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorGenericInternal",
+			})
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+		}
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessCategoryMove",
+			Other: "Category moved successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) getProfilePicture(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	message := doesUserExist(c, localizer)
+	if message != nil {
+		return c.JSON(http.StatusBadRequest, message)
+	}
+
+	userName := c.Param("name")
+
+	picturePath, err := models.Models.User.GetProfilePicture(userName)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorUserNotExists",
+		})
+
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/%s", picturePath))
+}
+
+func (s *Server) deleteCategory(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	id, err := readCategoryParam(c)
+	if err == nil {
+		err = models.Models.Catagory.Delete(id)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrCategoryNotExists",
+					Other: "That category dose not exist",
+				},
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "CategoryDeleteSuccess",
+			Other: "Category removed successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) postCategory(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	cat := &models.Catagory{}
+
+	err := c.Bind(cat)
+	if err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorGenericBadRequest",
+				Other: "Your request doe not match the specified format, please fix and try again",
+			},
+		})
+		return c.JSON(http.StatusBadRequest, message)
+	}
+
+	if msgs, err := Validator.Validate(cat, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	err = models.Models.Catagory.Insert(cat)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+		if message := duplicateCategoryMessage(err, localizer); message != "" {
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		}
+
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "CategoryCreatedSuccess",
+			Other: "Category created successfully",
+		},
+	})
+	return c.JSON(http.StatusCreated, echo.Map{"message": message})
+}
+
+// Replaces the category's name and details, fields left out of the body are reset
+func (s *Server) updateCategory(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Name         string `json:"name" validate:"required"`
+		Description  string `json:"description"`
+		Icon         string `json:"icon"`
+		Slug         string `json:"slug" validate:"omitempty,slug"`
+		DisplayOrder int    `json:"displayOrder"`
+		Archived     bool   `json:"archived"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	return s.saveCategoryChanges(c, localizer, models.CategoryChanges{
+		Name:         &i.Name,
+		Description:  &i.Description,
+		Icon:         &i.Icon,
+		Slug:         &i.Slug,
+		DisplayOrder: &i.DisplayOrder,
+		Archived:     &i.Archived,
+	})
+}
+
+// Changes only the fields sent in the body, an empty slug removes it
+func (s *Server) patchCategory(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Name         *string `json:"name"`
+		Description  *string `json:"description"`
+		Icon         *string `json:"icon"`
+		Slug         *string `json:"slug" validate:"omitempty,slug"`
+		DisplayOrder *int    `json:"displayOrder"`
+		Archived     *bool   `json:"archived"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	// omitempty can't tell a missing name from an empty one
+	if i.Name != nil && *i.Name == "" {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "Required",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": []validation.ApiError{{Field: "name", Msg: message}}})
+	}
+
+	return s.saveCategoryChanges(c, localizer, models.CategoryChanges{
+		Name:         i.Name,
+		Description:  i.Description,
+		Icon:         i.Icon,
+		Slug:         i.Slug,
+		DisplayOrder: i.DisplayOrder,
+		Archived:     i.Archived,
+	})
+}
+
+func (s *Server) saveCategoryChanges(c echo.Context, localizer *i18n.Localizer, changes models.CategoryChanges) error {
+	var cat *models.Catagory
+	id, err := readCategoryParam(c)
+	if err == nil {
+		cat, err = models.Models.Catagory.Update(id, changes)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+		if message := duplicateCategoryMessage(err, localizer); message != "" {
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessCategoryUpdate",
+			Other: "Category updated successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message, "category": cat})
+}
+
+// Returns the message for a taken category name or slug, or an empty string for other errors
+func duplicateCategoryMessage(err error, localizer *i18n.Localizer) string {
+	switch {
+	case errors.Is(err, models.ErrDuplicateCategoryName):
+		return localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorDuplicateCategoryName",
+				Other: "A category with that name already exists",
+			},
+		})
+	case errors.Is(err, models.ErrDuplicateCategorySlug):
+		return localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorDuplicateCategorySlug",
+				Other: "A category with that slug already exists",
+			},
+		})
+	}
+
+	return ""
+}
+
+// Lists the category's translations
+func (s *Server) getCategoryTranslations(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	var translations []*models.CategoryTranslation
+	id, err := readCategoryParam(c)
+	if err == nil {
+		translations, err = models.Models.Catagory.GetTranslations(id)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"defaultLocale": defaultCategoryLocale, "translations": translations})
+}
+
+// Adds or replaces the category's name and description in the locale
+func (s *Server) putCategoryTranslation(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	locale, message := readTranslationLocale(c, localizer)
+	if message != "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	t := &models.CategoryTranslation{}
+
+	if err := c.Bind(t); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(t, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	t.Locale = locale
+
+	id, err := readCategoryParam(c)
+	if err == nil {
+		err = models.Models.Catagory.SetTranslation(id, t)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+		if message := duplicateCategoryMessage(err, localizer); message != "" {
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message = localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessCategoryTranslationSave",
+			Other: "Category translation saved successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message, "translation": t})
 }
 
-func (s *Server) getAllCategories(c echo.Context) error {
-	input := &models.Filters{}
+func (s *Server) deleteCategoryTranslation(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
-	var err error
-	input.Page, err = strconv.Atoi(c.QueryParam("page"))
+	locale, message := readTranslationLocale(c, localizer)
+	if message != "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	id, err := readCategoryParam(c)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.Catagory.DeleteTranslation(id, locale)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorCategoryTranslationNotExists",
+					Other: "That category has no translation for this locale",
+				},
+			})
+			return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message = localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessCategoryTranslationDelete",
+			Other: "Category translation removed successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) postGroup(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	group := &models.Group{}
+
+	if err := c.Bind(group); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(group, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	err := models.Models.Group.Insert(group)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateGroupName) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorDuplicateGroupName",
+					Other: "A group with that name already exists",
+				},
+			})
+			return c.JSON(http.StatusConflict, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessGroupCreate",
+			Other: "Group created successfully",
+		},
+	})
+	return c.JSON(http.StatusCreated, echo.Map{"message": message, "group": group})
+}
+
+func (s *Server) getGroups(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "name", "created", "-id", "-name", "-created"}, "name")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	groups, metadata, err := models.Models.Group.GetAll(filters)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"groups": groups, "metadata": metadata})
+}
+
+func (s *Server) deleteGroup(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	err := models.Models.Group.Delete(c.Param("group"))
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessGroupDelete",
+			Other: "Group removed successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) getGroupMembers(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	filters, badParam := readFilters(c, []string{"id", "name", "email", "created", "-id", "-name", "-email", "-created"}, "name")
+	if badParam != "" {
+		return badQueryParam(c, localizer, badParam)
+	}
+	if field := readSort(c, &filters); field != "" {
+		return badSortField(c, localizer, filters, field)
+	}
+	if !filters.CursorIsValid() {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+
+	members, metadata, err := models.Models.Group.GetMembers(c.Param("group"), filters)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return badQueryParam(c, localizer, cursorParam(filters))
+	}
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"members": members, "metadata": metadata})
+}
+
+// Adds the users to the group, they see the group's categories from their next request
+func (s *Server) addGroupMembers(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		UserNames []string `json:"userNames" validate:"required"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	err := models.Models.Group.AddMembers(c.Param("group"), i.UserNames)
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessGroupMembersAdd",
+			Other: "Users added to the group successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) removeGroupMember(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	err := models.Models.Group.RemoveMember(c.Param("group"), c.Param("user"))
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessGroupMemberRemove",
+			Other: "User removed from the group successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+func (s *Server) getGroupCategories(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	categories, err := models.Models.Group.GetCategories(c.Param("group"))
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"categories": categories})
+}
+
+// Activates or deactivates categories for every member of the group,
+// the same way setCategoryVisibilityOnUser does for one user
+func (s *Server) setGroupCategories(c echo.Context) error {
+	lang := c.Request().Header.Get("Accept-Language")
+	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+
+	type input struct {
+		Categories           []string `json:"categories" validate:"required"`
+		Activate             bool     `json:"activate"`
+		IncludeSubcategories bool     `json:"includeSubcategories"`
+	}
+
+	i := &input{}
+
+	if err := c.Bind(i); err != nil {
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericBadRequest",
+		})
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	}
+
+	if msgs, err := Validator.Validate(i, lang); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	}
+
+	categoryIDs, err := resolveCategories(i.Categories)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrCategoryNotExists",
+			})
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		}
+
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	err = models.Models.Group.EditCategories(c.Param("group"), categoryIDs, i.Activate, i.IncludeSubcategories)
+	if err != nil {
+		return groupError(c, localizer, err)
+	}
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SuccessGroupCategoriesUpdate",
+			Other: "Group categories updated successfully",
+		},
+	})
+	return c.JSON(http.StatusOK, echo.Map{"message": message})
+}
+
+// Returns ture if the JWT user is the same
+// as the user in the url params OR if the jwt
+// user is allowed to manage other users
+func ValidTokenForParam(c echo.Context) bool {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	tokenUser := claims["name"].(string)
+
+	paramUser := c.Param("name")
+
+	return paramUser == tokenUser || hasPermission(c, models.PermissionUsersWrite)
+}
+
+// Returns true if the JWT user is the user in the url params,
+// unlike ValidTokenForParam admins don't get a pass
+func isTokenUser(c echo.Context) bool {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	tokenUser := claims["name"].(string)
+
+	return c.Param("name") == tokenUser
+}
+
+// Checks the code against the user's TOTP secret,
+// every code can only be used once
+func verifyTOTPCode(userID int, code string) error {
+	secret, _, err := models.Models.User.GetTOTP(userID)
 	if err != nil {
 		return err
 	}
-	input.PageSize, err = strconv.Atoi(c.QueryParam("pageSize"))
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return errors.New("invalid totp code")
+	}
+
+	return models.Models.User.UseTOTPStep(userID, step)
+}
+
+// Finishes a login, users with 2FA get a challenge token they have to
+// send back with a TOTP code, everyone else gets their tokens right away
+func startSession(c echo.Context, localizer *i18n.Localizer, user *models.User) error {
+	if user.TOTPEnabled {
+		challenge, err := auth.CreateChallengeToken(user)
+		if err != nil {
+			c.Logger().Error(err)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID: "ErrorGenericInternal",
+			})
+			return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{"twoFactorRequired": true, "challengeToken": challenge})
+	}
+
+	tokens, err := auth.NewSession(user, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		c.Logger().Error(err, user)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		c.Logger().Error(err)
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+var errProviderEmailNotVerified = errors.New("the provider has not verified the email")
+
+// Links a new external identity to the user with the same email if the provider allows it,
+// otherwise creates a user for it, named after the identity with a number added if the name is taken
+func linkOrProvisionUser(provider *oidc.Provider, identity *oidc.Identity) (*models.User, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, errProviderEmailNotVerified
+	}
+
+	link := &models.Identity{
+		Provider: provider.Name,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	// Users are only linked when this is the email they verified, whoever registered
+	// the account or changed its email to this one may not own it. Anyone else
+	// with the email is refused when the new user can't be created
+	if provider.LinkByEmail {
+		user, err := models.Models.User.GetUserByVerifiedEmail(identity.Email)
+		if err != nil && !errors.Is(err, models.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			link.UserID = user.ID
+			return user, models.Models.Identity.Link(link)
+		}
+	}
+
+	password, err := oidc.RandomString()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var cats []*models.Catagory
-	var metadata models.Metadata
-	if isAdmin(c) {
-		cats, metadata, err = models.Models.Catagory.GetAll(*input)
-		if err != nil {
-			c.Logger().Error(err)
-			return err
+	baseName := oidcUserName(identity)
+
+	userName := baseName
+	for attempt := 0; attempt < 5; attempt++ {
+		user := &models.User{
+			UserName:         userName,
+			Email:            identity.Email,
+			UnhashedPassword: password,
+		}
+
+		err = models.Models.Identity.Provision(user, link)
+		if err == nil {
+			models.Models.User.SetUserRole(user)
+			return user, nil
+		}
+		if !errors.Is(err, models.ErrDuplicateUserName) {
+			return nil, err
 		}
-	} else {
-		c.Logger().Error("EL:KADJF")
-		userID := getIDFromToken(c)
 
-		cats, metadata, err = models.Models.Catagory.GetAllActive(userID, *input)
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
 		if err != nil {
-			c.Logger().Error(err)
-			return err
+			return nil, err
 		}
+		userName = fmt.Sprintf("%s-%d", baseName, suffix)
 	}
-	return c.JSON(http.StatusOK, echo.Map{"categories": cats, "metadata": metadata})
+
+	return nil, err
 }
 
-func (s *Server) getProfilePicture(c echo.Context) error {
-	lang := c.Request().Header.Get("Accept-Language")
-	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+// Makes a user name out of what the provider calls the user, only letters, digits, dots,
+// dashes and underscores are kept so it's safe in our URLs, and it's checked with the
+// same rules as the names people register with
+func oidcUserName(identity *oidc.Identity) string {
+	name := identity.PreferredUsername
+	if name == "" {
+		name = identity.Email
+	}
+	name, _, _ = strings.Cut(strings.TrimSpace(name), "@")
 
-	message := doesUserExist(c, localizer)
-	if message != nil {
-		return c.JSON(http.StatusBadRequest, message)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+
+	if runes := []rune(name); len(runes) > maxOIDCUserNameLength {
+		name = string(runes[:maxOIDCUserNameLength])
 	}
 
-	userName := c.Param("name")
+	err := Validator.V.StructPartial(&models.User{UserName: name}, "UserName")
+	if err != nil {
+		return "user"
+	}
 
-	picturePath, err := models.Models.User.GetProfilePicture(userName)
+	return name
+}
+
+func isAdmin(c echo.Context) bool {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	return claims["admin"].(bool)
+}
+
+// Returns true if the request was authenticated with an API key instead of a JWT
+func isApiKey(c echo.Context) bool {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	_, ok := claims["apiKey"]
+	return ok
+}
+
+func hasPermission(c echo.Context, permission string) bool {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	return slices.Contains(tokenScopes(claims), permission)
+}
+
+func tokenScopes(claims jwt.MapClaims) []string {
+	rawScopes, _ := claims["scopes"].([]interface{})
+
+	scopes := make([]string, 0, len(rawScopes))
+	for _, rawScope := range rawScopes {
+		if scope, ok := rawScope.(string); ok {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
+
+func doesUserExist(c echo.Context, localizer *i18n.Localizer) echo.Map {
+	userName := c.Param("name")
+	_, err := models.Models.User.GetUserByName(userName)
 	if err != nil {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorUserNotExists",
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorUserNotExists",
+				Other: "No user with that name has been found",
+			},
 		})
+		return echo.Map{"error": message}
+	}
+	return nil
+}
 
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+func getIDFromToken(c echo.Context) int {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	userIDF := claims["id"].(float64)
+	userID := int(userIDF)
+
+	return userID
+}
+
+func getSessionIDFromToken(c echo.Context) int64 {
+	token := c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	// API keys aren't bound to a session
+	sessionID, _ := claims["sid"].(float64)
+
+	return int64(sessionID)
+}
+
+// Creates a new verification token for the user and emails them the link
+func (s *Server) sendVerificationEmail(c echo.Context, localizer *i18n.Localizer, user *models.User) error {
+	token, err := models.Models.Token.New(user.ID, verificationTokenTTL, models.ScopeVerification)
+	if err != nil {
+		return err
 	}
 
-	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/%s", picturePath))
+	data := map[string]string{
+		"UserName": user.UserName,
+		"Token":    token,
+		"Link":     fmt.Sprintf("%s/verify?token=%s", appURL, token),
+	}
+
+	subject := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "EmailVerificationSubject",
+			Other: "Verify your email",
+		},
+	})
+	body := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "EmailVerificationBody",
+			Other: "Welcome {{.UserName}}, please verify your email by following this link: {{.Link}} the link expires in three days",
+		},
+		TemplateData: data,
+	})
+
+	s.sendEmail(c, user.Email, subject, body)
+
+	return nil
 }
 
-func (s *Server) deleteCategory(c echo.Context) error {
+// Sends the email in the background so the response isn't held up by the mail server
+func (s *Server) sendEmail(c echo.Context, recipient, subject, body string) {
+	logger := c.Logger()
+
+	go func() {
+		err := s.mailer.Send(recipient, subject, body)
+		if err != nil {
+			logger.Error(err)
+		}
+	}()
+}
+
+// Grants or revokes the role, the change shows up on the user's next request
+// since every token is checked against the roles in the database
+func changeRole(c echo.Context, userName, role string, grant bool) error {
 	lang := c.Request().Header.Get("Accept-Language")
 	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
 
-	name := c.Param("name")
+	var err error
+	if grant {
+		err = models.Models.Role.Grant(userName, role)
+	} else {
+		err = models.Models.Role.Revoke(userName, role)
+	}
 
-	err := models.Models.Catagory.DeleteByName(name)
-	if err != nil {
+	switch {
+	case errors.Is(err, models.ErrRecordNotFound):
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			DefaultMessage: &i18n.Message{
-				ID:    "ErrCategoryNotExists",
-				Other: "That category dose not exist",
+				ID:    "ErrorUserOrRoleNotExists",
+				Other: "That user or role does not exist, or the user does not have that role",
 			},
 		})
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
+	case errors.Is(err, models.ErrLastAdmin):
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorLastAdmin",
+				Other: "The last admin can not be demoted or deleted",
+			},
+		})
+		return c.JSON(http.StatusConflict, echo.Map{"error": message})
+	case err != nil:
+		c.Logger().Error(err)
+		message := localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "ErrorGenericInternal",
+		})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 	}
 
 	message := localizer.MustLocalize(&i18n.LocalizeConfig{
 		DefaultMessage: &i18n.Message{
-			ID:    "CategoryDeleteSuccess",
-			Other: "Category removed successfully",
+			ID:    "SuccessRolesUpdated",
+			Other: "Roles updated successfully",
 		},
 	})
 	return c.JSON(http.StatusOK, echo.Map{"message": message})
 }
 
-func (s *Server) postCategory(c echo.Context) error {
-	lang := c.Request().Header.Get("Accept-Language")
-	localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+func getIDFromParam(c echo.Context) (int, error) {
+	idString := c.Param("id")
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		return 0, err
+	}
 
-	cat := &models.Catagory{}
+	return id, nil
+}
 
-	err := c.Bind(cat)
-	if err != nil {
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			DefaultMessage: &i18n.Message{
-				ID:    "ErrorGenericBadRequest",
-				Other: "Your request doe not match the specified format, please fix and try again",
-			},
-		})
-		return c.JSON(http.StatusBadRequest, message)
+// Reads the page, pageSize, after and before query parameters, falling back to the defaults
+// for missing ones, returns the name of the first parameter with an invalid value
+func readFilters(c echo.Context, sortSafeList []string, defaultSort string) (models.Filters, string) {
+	filters := models.Filters{
+		Page:         1,
+		PageSize:     defaultPageSize,
+		Sort:         defaultSort,
+		SortSafeList: sortSafeList,
 	}
 
-	if msgs, err := Validator.Validate(cat, lang); err != nil {
-		return c.JSON(http.StatusBadRequest, echo.Map{"errors": msgs})
+	if value := c.QueryParam("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 || page > maxPage {
+			return filters, "page"
+		}
+		filters.Page = page
 	}
 
-	err = models.Models.Catagory.Insert(cat)
-	if err != nil {
-		message := localizer.MustLocalize(&i18n.LocalizeConfig{
-			MessageID: "ErrorGenericInternal",
-		})
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
+	if value := c.QueryParam("pageSize"); value != "" {
+		pageSize, err := strconv.Atoi(value)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			return filters, "pageSize"
+		}
+		filters.PageSize = pageSize
+	}
+
+	// Sending after or before, even empty, switches to cursors,
+	// an empty before starts from the last page
+	query := c.QueryParams()
+	if query.Has("after") && query.Has("before") {
+		return filters, "before"
+	}
+	if query.Has("after") || query.Has("before") {
+		filters.UseCursor = true
+		filters.Backwards = query.Has("before")
+		filters.After = query.Get("after")
+		filters.Before = query.Get("before")
+	}
+
+	return filters, ""
+}
+
+// Reads the sort query parameter into the filters, returns the first
+// field that isn't allowed so it can be reported back
+func readSort(c echo.Context, filters *models.Filters) string {
+	if value := c.QueryParam("sort"); value != "" {
+		filters.Sort = value
+	}
+
+	return filters.UnknownSortField()
+}
+
+// The name of the cursor parameter that was sent, for error messages
+func cursorParam(filters models.Filters) string {
+	if filters.Before != "" {
+		return "before"
+	}
+	return "after"
+}
+
+func badSortField(c echo.Context, localizer *i18n.Localizer, filters models.Filters, field string) error {
+	// The descending versions are implied by the ascending ones
+	allowed := []string{}
+	for _, safeField := range filters.SortSafeList {
+		if !strings.HasPrefix(safeField, "-") {
+			allowed = append(allowed, safeField)
+		}
 	}
 
 	message := localizer.MustLocalize(&i18n.LocalizeConfig{
 		DefaultMessage: &i18n.Message{
-			ID:    "CategoryCreatedSuccess",
-			Other: "Category created successfully",
+			ID:    "ErrorUnknownSortField",
+			Other: "Sorting by {{.Field}} is not supported, use one of: {{.Allowed}}",
 		},
+		TemplateData: map[string]string{"Field": field, "Allowed": strings.Join(allowed, ", ")},
 	})
-	return c.JSON(http.StatusCreated, echo.Map{"message": message})
+	return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
 }
 
-// Returns ture if the JWT user is the same
-// as the user in the url params OR if the jwt
-// user is an admin
-func ValidTokenForParam(c echo.Context) bool {
-	token := c.Get("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	tokenUser := claims["name"].(string)
-	isAdmin := claims["admin"].(bool)
+// Accepts full RFC 3339 timestamps or plain dates
+func parseDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, nil
+	}
 
-	paramUser := c.Param("name")
+	return time.Parse(time.DateOnly, value)
+}
 
-	return paramUser == tokenUser || isAdmin
+func badQueryParam(c echo.Context, localizer *i18n.Localizer, param string) error {
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorInvalidQueryParameter",
+			Other: "Invalid value for the {{.Param}} parameter",
+		},
+		TemplateData: map[string]string{"Param": param},
+	})
+	return c.JSON(http.StatusBadRequest, echo.Map{"error": message})
 }
 
-func isAdmin(c echo.Context) bool {
-	token := c.Get("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	return claims["admin"].(bool)
+func categoryLocaleFromEnv() string {
+	tag, err := language.Parse(os.Getenv("CATEGORY_DEFAULT_LOCALE"))
+	if err != nil {
+		return "en"
+	}
+
+	return tag.String()
 }
 
-func doesUserExist(c echo.Context, localizer *i18n.Localizer) echo.Map {
-	userName := c.Param("name")
-	_, err := models.Models.User.GetUserByName(userName)
+// The locales to show categories in, in the order the client prefers them. The ones after
+// the default locale are dropped since every category has its name in the default locale
+func categoryLocales(c echo.Context) []string {
+	locales := []string{}
+
+	tags, _, err := language.ParseAcceptLanguage(c.Request().Header.Get("Accept-Language"))
+	if err != nil {
+		return locales
+	}
+
+	for _, tag := range tags {
+		base, _ := tag.Base()
+		for _, locale := range []string{tag.String(), base.String()} {
+			if locale == defaultCategoryLocale {
+				return locales
+			}
+			if !slices.Contains(locales, locale) {
+				locales = append(locales, locale)
+			}
+		}
+	}
+
+	return locales
+}
+
+// Returns the locale in the url params in its canonical form, or the message to respond with
+// if it's invalid. The default locale can't have translations, it's the category itself
+func readTranslationLocale(c echo.Context, localizer *i18n.Localizer) (string, string) {
+	tag, err := language.Parse(c.Param("locale"))
 	if err != nil {
+		return "", localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorInvalidLocale",
+				Other: "That locale is not valid",
+			},
+		})
+	}
+
+	if tag.String() == defaultCategoryLocale {
+		return "", localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "ErrorDefaultLocaleTranslation",
+				Other: "Categories are already in the default locale, update the category itself instead",
+			},
+		})
+	}
+
+	return tag.String(), ""
+}
+
+// Finds the category in the url params by its ID, slug or name. Echo leaves the
+// params escaped when the path has an escaped slash in it, so they're unescaped here
+func readCategoryParam(c echo.Context) (int, error) {
+	ref := c.Param("category")
+	if c.Request().URL.RawPath != "" {
+		unescaped, err := url.PathUnescape(ref)
+		if err != nil {
+			return 0, models.ErrRecordNotFound
+		}
+		ref = unescaped
+	}
+
+	return models.Models.Catagory.Resolve(ref)
+}
+
+// Finds the IDs of the categories referenced by their ID, slug or name
+func resolveCategories(refs []string) ([]int, error) {
+	ids := []int{}
+	for _, ref := range refs {
+		id, err := models.Models.Catagory.Resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Responds to errors of the group endpoints, ErrRecordNotFound means the group
+// doesn't exist or one of the users in the request isn't in it or doesn't exist
+func groupError(c echo.Context, localizer *i18n.Localizer, err error) error {
+	if errors.Is(err, models.ErrRecordNotFound) {
 		message := localizer.MustLocalize(&i18n.LocalizeConfig{
 			DefaultMessage: &i18n.Message{
-				ID:    "ErrorUserNotExists",
-				Other: "No user with that name has been found",
+				ID:    "ErrorGroupMemberNotExists",
+				Other: "That group or one of the users does not exist",
 			},
 		})
-		return echo.Map{"error": message}
+		return c.JSON(http.StatusNotFound, echo.Map{"error": message})
 	}
-	return nil
+
+	c.Logger().Error(err)
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		MessageID: "ErrorGenericInternal",
+	})
+	return c.JSON(http.StatusInternalServerError, echo.Map{"error": message})
 }
 
-func getIDFromToken(c echo.Context) int {
-	token := c.Get("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userIDF := claims["id"].(float64)
-	userID := int(userIDF)
-	c.Logger().Error(userID)
+func tooManyAttempts(c echo.Context, localizer *i18n.Localizer) error {
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorTooManyLoginAttempts",
+			Other: "Too many failed login attempts, please try again later",
+		},
+	})
+	return c.JSON(http.StatusTooManyRequests, echo.Map{"error": message})
+}
 
-	return userID
+func accountLocked(c echo.Context, localizer *i18n.Localizer, lockedUntil time.Time) error {
+	lockedFor := time.Until(lockedUntil).Round(time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(lockedFor.Seconds())))
+
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorAccountLocked",
+			Other: "Your account has been locked after too many failed login attempts, try again in {{.Minutes}} minutes",
+		},
+		TemplateData: map[string]int{"Minutes": int(math.Ceil(lockedFor.Minutes()))},
+	})
+	return c.JSON(http.StatusLocked, echo.Map{"error": message})
 }
 
-func getIDFromParam(c echo.Context) (int, error) {
-	idString := c.Param("id")
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		return 0, err
+// Responds to a failed check of the user's current password the same way login does
+func passwordCheckFailed(c echo.Context, localizer *i18n.Localizer, user *models.User, err error) error {
+	switch {
+	case errors.Is(err, models.ErrTooManyAttempts):
+		return tooManyAttempts(c, localizer)
+	case errors.Is(err, models.ErrAccountLocked):
+		return accountLocked(c, localizer, *user.LockedUntil)
+	case !errors.Is(err, models.ErrIncorrectPassword):
+		c.Logger().Error(err)
 	}
 
-	return id, nil
+	message := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ErrorIncorrectPassword",
+			Other: "The password you entered is incorrect",
+		},
+	})
+	return c.JSON(http.StatusUnauthorized, echo.Map{"error": message})
 }
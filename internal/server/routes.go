@@ -1,15 +1,23 @@
 package server
 
 import (
+	"Sadeem-RestAPI/internal/auth"
+	"Sadeem-RestAPI/internal/models"
+	"Sadeem-RestAPI/internal/translation"
+	"errors"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
-var signingKey = os.Getenv("JWT_SIGNING_KEY")
-
 func (s *Server) RegisterRoutes() *echo.Echo {
 	e := echo.New()
 
@@ -17,40 +25,318 @@ func (s *Server) RegisterRoutes() *echo.Echo {
 	e.Use(middleware.Recover())
 	e.Use(middleware.Static(os.Getenv("PICTURE_DIR")))
 
+	e.GET("/.well-known/jwks.json", s.getJWKS)
+
 	// POST
 	e.POST("api/users", s.registerUser)
-	e.POST("api/categories", jwtMiddleWare(adminMiddleWare(s.postCategory)))
+	e.POST("api/users/verify", s.verifyUser)
+	e.POST("api/users/:name/verify", jwtMiddleWare(requirePermission(models.PermissionUsersWrite)(s.manuallyVerifyUser)))
+	e.POST("api/users/:name/verification", jwtMiddleWare(requirePermission(models.PermissionUsersWrite)(s.resendVerification)))
+	e.POST("api/categories", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.postCategory)))
 	e.POST("api/login", s.login)
-	e.POST("api/user-categories", jwtMiddleWare(adminMiddleWare(s.setCategoryVisibilityOnUser)))
+	e.POST("api/login/2fa", s.loginTwoFactor)
+	e.POST("api/token/refresh", s.refreshToken)
+	e.POST(logoutPath, jwtMiddleWare(s.logout))
+	e.POST("api/logout/all", jwtMiddleWare(rejectApiKeys(s.logoutEverywhere)))
+	e.POST("api/password/forgot", s.forgotPassword)
+	e.POST("api/password/reset", s.resetPassword)
+	e.POST("api/users/:name/2fa", jwtMiddleWare(rejectApiKeys(s.enrollTwoFactor)))
+	e.POST("api/users/:name/2fa/confirm", jwtMiddleWare(rejectApiKeys(s.confirmTwoFactor)))
+	e.POST("api/users/:name/unlock", jwtMiddleWare(requirePermission(models.PermissionUsersWrite)(s.unlockUser)))
+	e.POST("api/admins", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.promoteAdmin)))
+	e.POST("api/users/:name/roles", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.grantRole)))
+	e.POST("api/users/:name/api-keys", jwtMiddleWare(s.createApiKey))
+	e.POST("api/users/:name/impersonate", jwtMiddleWare(requirePermission(models.PermissionUsersImpersonate)(s.impersonateUser)))
+	e.POST("api/user-categories", jwtMiddleWare(requirePermission(models.PermissionUserCategoriesAssign)(s.setCategoryVisibilityOnUser)))
+	e.POST("api/groups", jwtMiddleWare(requirePermission(models.PermissionGroupsWrite)(s.postGroup)))
+	e.POST("api/groups/:group/members", jwtMiddleWare(requirePermission(models.PermissionGroupsWrite)(s.addGroupMembers)))
+	e.POST("api/groups/:group/categories", jwtMiddleWare(requirePermission(models.PermissionGroupsWrite)(s.setGroupCategories)))
 
 	// GET
+	e.GET("api/users", jwtMiddleWare(requirePermission(models.PermissionUsersRead)(s.getUsers)))
 	e.GET("api/users/:name", jwtMiddleWare((s.getUserByUserName)))
 	e.GET("api/users/:name/profile-picture", jwtMiddleWare(s.getProfilePicture))
 	e.GET("api/categories", jwtMiddleWare(s.getAllCategories))
+	e.GET("api/categories/tree", jwtMiddleWare(s.getCategoryTree))
+	e.GET("api/categories/:category/translations", jwtMiddleWare(requirePermission(models.PermissionCategoriesRead)(s.getCategoryTranslations)))
+	e.GET("api/users/:name/api-keys", jwtMiddleWare(s.getApiKeys))
+	e.GET("api/users/:name/sessions", jwtMiddleWare(s.getSessions))
+	e.GET("api/oidc/providers", s.getOIDCProviders)
+	e.GET("api/oidc/:provider/login", s.oidcLogin)
+	e.GET("api/oidc/:provider/callback", s.oidcCallback)
+	e.GET("api/login-attempts", jwtMiddleWare(requirePermission(models.PermissionUsersRead)(s.getLoginAttempts)))
+	e.GET("api/audit-log", jwtMiddleWare(requirePermission(models.PermissionUsersRead)(s.getAuditLog)))
+	e.GET("api/roles", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.getRoles)))
+	e.GET("api/admins", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.getAdmins)))
+	e.GET("api/groups", jwtMiddleWare(requirePermission(models.PermissionGroupsRead)(s.getGroups)))
+	e.GET("api/groups/:group/members", jwtMiddleWare(requirePermission(models.PermissionGroupsRead)(s.getGroupMembers)))
+	e.GET("api/groups/:group/categories", jwtMiddleWare(requirePermission(models.PermissionGroupsRead)(s.getGroupCategories)))
 
 	// PUT
-	e.PUT("api/users/:id", jwtMiddleWare(s.updateUser))
-	e.PUT("api/users/:name/profile-picture", jwtMiddleWare(s.updateProfilePicture))
+	e.PUT("api/users/:id", jwtMiddleWare(rejectApiKeys(s.updateUser)))
+	e.PUT("api/users/:name/profile-picture", jwtMiddleWare(rejectApiKeys(s.updateProfilePicture)))
+	e.PUT("api/users/:name/password", jwtMiddleWare(s.changePassword))
+	e.PUT("api/categories/:category", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.updateCategory)))
+	e.PUT("api/categories/:category/translations/:locale", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.putCategoryTranslation)))
+	e.PUT("api/categories/:category/parent", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.moveCategory)))
+
+	// PATCH
+	e.PATCH("api/categories/:category", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.patchCategory)))
 
 	// DELETE
-	e.DELETE("api/users/:name", jwtMiddleWare(s.deleteUser))
-	e.DELETE("api/users/:name/profile-picture", jwtMiddleWare(s.deleteProfilePicture))
-	e.DELETE("api/categories/:name", jwtMiddleWare(adminMiddleWare(s.deleteCategory)))
+	e.DELETE("api/users/:name", jwtMiddleWare(rejectApiKeys(s.deleteUser)))
+	e.DELETE("api/users/:name/profile-picture", jwtMiddleWare(rejectApiKeys(s.deleteProfilePicture)))
+	e.DELETE("api/users/:name/2fa", jwtMiddleWare(rejectApiKeys(s.disableTwoFactor)))
+	e.DELETE("api/users/:name/api-keys/:id", jwtMiddleWare(rejectApiKeys(s.deleteApiKey)))
+	e.DELETE("api/users/:name/sessions/:id", jwtMiddleWare(rejectApiKeys(s.deleteSession)))
+	e.DELETE("api/admins/:name", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.demoteAdmin)))
+	e.DELETE("api/users/:name/roles/:role", jwtMiddleWare(requirePermission(models.PermissionRolesWrite)(s.revokeRole)))
+	e.DELETE("api/categories/:category", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.deleteCategory)))
+	e.DELETE("api/categories/:category/translations/:locale", jwtMiddleWare(requirePermission(models.PermissionCategoriesWrite)(s.deleteCategoryTranslation)))
+	e.DELETE("api/groups/:group", jwtMiddleWare(requirePermission(models.PermissionGroupsWrite)(s.deleteGroup)))
+	e.DELETE("api/groups/:group/members/:user", jwtMiddleWare(requirePermission(models.PermissionGroupsWrite)(s.removeGroupMember)))
 
 	return e
 }
 
-func adminMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+// Only lets the request through if the token has every one of the permissions
+func requirePermission(permissions ...string) func(echo.HandlerFunc) echo.HandlerFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, permission := range permissions {
+				if !hasPermission(c, permission) {
+					return echo.ErrForbidden
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// Keeps API keys away from managing the account itself, a leaked key
+// shouldn't be enough to take the account over or lock its owner out
+func rejectApiKeys(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if !isAdmin(c) {
-			return echo.ErrUnauthorized
+		if isApiKey(c) {
+			return echo.ErrForbidden
 		}
 		return next(c)
 	}
 }
 
 // Middleware for JWT Authintication
-var jwtMiddleWare = echojwt.WithConfig(echojwt.Config{
-	SigningMethod: "HS512",
-	SigningKey:    []byte(signingKey),
+var bearerMiddleWare = echojwt.WithConfig(echojwt.Config{
+	ParseTokenFunc: parseToken,
 })
+
+// Authenticates the request with either a Bearer JWT or a personal API key,
+// both end up as the same claims in the context so handlers don't care which was used
+func jwtMiddleWare(next echo.HandlerFunc) echo.HandlerFunc {
+	withBearer := bearerMiddleWare(impersonationGuard(next))
+
+	return func(c echo.Context) error {
+		authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
+
+		apiKey, found := strings.CutPrefix(authHeader, "ApiKey ")
+		if !found {
+			return withBearer(c)
+		}
+
+		token, err := parseApiKey(apiKey)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.ErrUnauthorized
+		}
+
+		c.Set("user", token)
+		return next(c)
+	}
+}
+
+// Registered with the leading slash Echo adds anyway, so impersonationGuard can
+// compare it with c.Path()
+const logoutPath = "/api/logout"
+
+// Impersonation tokens can only read, anything else is refused except logging out,
+// every request made with one ends up in the audit log
+func impersonationGuard(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+
+		actorID, impersonated := impersonatorID(claims)
+		if !impersonated {
+			return next(c)
+		}
+
+		var err error
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			err = next(c)
+		default:
+			if c.Path() == logoutPath {
+				err = next(c)
+				break
+			}
+
+			lang := c.Request().Header.Get("Accept-Language")
+			localizer := i18n.NewLocalizer(&translation.Bundle, lang)
+			message := localizer.MustLocalize(&i18n.LocalizeConfig{
+				DefaultMessage: &i18n.Message{
+					ID:    "ErrorImpersonationReadOnly",
+					Other: "This action is not allowed while impersonating a user",
+				},
+			})
+			err = c.JSON(http.StatusForbidden, echo.Map{"error": message})
+		}
+
+		status := c.Response().Status
+		var httpError *echo.HTTPError
+		if errors.As(err, &httpError) {
+			status = httpError.Code
+		}
+
+		actor, _ := claims["act"].(map[string]interface{})
+		actorName, _ := actor["name"].(string)
+		userID, _ := claims["id"].(float64)
+		userName, _ := claims["name"].(string)
+
+		auditErr := models.Models.Audit.Insert(&models.AuditEntry{
+			ActorID:   actorID,
+			ActorName: actorName,
+			UserID:    int(userID),
+			UserName:  userName,
+			Action:    models.AuditImpersonationRequest,
+			Method:    c.Request().Method,
+			Path:      c.Request().URL.RequestURI(),
+			Status:    status,
+			IP:        c.RealIP(),
+		})
+		if auditErr != nil {
+			c.Logger().Error(auditErr)
+		}
+
+		return err
+	}
+}
+
+// Returns the ID of the staff member if the token is an impersonation token
+func impersonatorID(claims jwt.MapClaims) (int, bool) {
+	actor, ok := claims["act"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+
+	subject, _ := actor["sub"].(string)
+	actorID, err := strconv.Atoi(subject)
+	if err != nil {
+		// A broken act claim still marks the token as an impersonation token
+		return 0, true
+	}
+
+	return actorID, true
+}
+
+// Builds the claims for an API key, the key gets the scopes it was created
+// with minus any permission the user has lost since then
+func parseApiKey(plainText string) (*jwt.Token, error) {
+	key, user, err := models.Models.ApiKey.GetByKey(plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key gets what a token of its owner would, so owners that still have
+	// to set up 2FA get no more out of their keys than out of logging in
+	owner, err := models.Models.User.GetUserByID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions := auth.GrantedScopes(owner)
+
+	scopes := []interface{}{}
+	for _, scope := range key.Scopes {
+		if slices.Contains(permissions, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	claims := jwt.MapClaims{
+		"name":   user.UserName,
+		"id":     float64(user.ID),
+		"admin":  auth.HasAdminRights(owner) && len(scopes) == len(permissions),
+		"scopes": scopes,
+		"apiKey": float64(key.ID),
+		"exp":    float64(key.Expiry.Unix()),
+	}
+
+	return &jwt.Token{Claims: claims, Valid: true}, nil
+}
+
+// Verifies the token signature and checks it against the current state of things,
+// tokens that were revoked, belong to a logged out session, a deleted user
+// or a user that has since lost some of their permissions are rejected
+func parseToken(c echo.Context, rawToken string) (interface{}, error) {
+	token, err := auth.ParseToken(rawToken, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	tokenID, ok := claims["jti"].(string)
+	if !ok {
+		return nil, errors.New("token has no ID")
+	}
+
+	revoked, err := models.Models.Revoked.IsRevoked(tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+
+	sessionID, ok := claims["sid"].(float64)
+	if !ok {
+		return nil, errors.New("token is not bound to a session")
+	}
+
+	active, err := models.Models.Session.IsActive(int64(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, errors.New("session has been revoked")
+	}
+
+	// Impersonation stops as soon as the staff member loses the permission
+	if actorID, impersonated := impersonatorID(claims); impersonated {
+		exists, _, permissions, err := models.Models.User.GetAuthStatus(actorID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists || !slices.Contains(permissions, models.PermissionUsersImpersonate) {
+			return nil, errors.New("impersonator is no longer allowed to impersonate")
+		}
+	}
+
+	userID, _ := claims["id"].(float64)
+	exists, admin, permissions, err := models.Models.User.GetAuthStatus(int(userID))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("user no longer exists")
+	}
+
+	if tokenAdmin, _ := claims["admin"].(bool); tokenAdmin && !admin {
+		return nil, errors.New("user is no longer an admin")
+	}
+
+	for _, scope := range tokenScopes(claims) {
+		if !slices.Contains(permissions, scope) {
+			return nil, errors.New("user no longer has the permissions of the token")
+		}
+	}
+
+	return token, nil
+}
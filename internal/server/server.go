@@ -1,20 +1,32 @@
 package server
 
 import (
+	"Sadeem-RestAPI/internal/mailer"
+	"Sadeem-RestAPI/internal/oidc"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 )
 
 var port = 8080
 
 type Server struct {
-	port int
+	port          int
+	mailer        mailer.Mailer
+	oidcProviders map[string]*oidc.Provider
 }
 
 func NewServer() *http.Server {
+	oidcProviders, err := oidc.LoadProviders(os.Getenv("OIDC_PROVIDERS_FILE"))
+	if err != nil {
+		panic("could not load the OIDC providers: " + err.Error())
+	}
+
 	NewServer := &Server{
-		port: port,
+		port:          port,
+		mailer:        mailer.New(),
+		oidcProviders: oidcProviders,
 	}
 
 	// Declare Server config
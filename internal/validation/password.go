@@ -0,0 +1,151 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator"
+)
+
+// Used when PASSWORD_BLOCKLIST_FILE is not set
+//
+//go:embed common-passwords.txt
+var defaultBlocklist []byte
+
+// Rules every new password has to follow, configured from the environment
+type PasswordPolicy struct {
+	MinLength int
+	// How many of lowercase, uppercase, digits and symbols the password needs
+	MinCharacterClasses int
+	// Reject passwords containing the user's name or email
+	RejectPersonalInfo bool
+	// Lower cased passwords that are too common to be allowed
+	Blocklist map[string]struct{}
+}
+
+var Policy = loadPasswordPolicy()
+
+func loadPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:           8,
+		MinCharacterClasses: 2,
+		RejectPersonalInfo:  os.Getenv("PASSWORD_ALLOW_PERSONAL_INFO") != "true",
+	}
+
+	if minLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && minLength > 0 {
+		policy.MinLength = minLength
+	}
+
+	if minClasses, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CHARACTER_CLASSES")); err == nil && minClasses >= 0 && minClasses <= 4 {
+		policy.MinCharacterClasses = minClasses
+	}
+
+	blocklist := defaultBlocklist
+	if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			panic("could not read the password blocklist file " + path)
+		}
+		blocklist = file
+	}
+	policy.Blocklist = parseBlocklist(blocklist)
+
+	return policy
+}
+
+func parseBlocklist(file []byte) map[string]struct{} {
+	blocklist := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocklist[strings.ToLower(line)] = struct{}{}
+	}
+
+	return blocklist
+}
+
+// Registers the password tags, "password" runs every rule of the policy
+// while each rule gets its own tag so it gets its own message
+func registerPasswordTags(v *validator.Validate) {
+	v.RegisterValidation("password_length", validatePasswordLength)
+	v.RegisterValidation("password_classes", validatePasswordClasses)
+	v.RegisterValidation("password_personal", validatePasswordPersonal)
+	v.RegisterValidation("password_common", validatePasswordCommon)
+	v.RegisterAlias("password", "password_length,password_classes,password_personal,password_common")
+}
+
+func validatePasswordLength(fl validator.FieldLevel) bool {
+	return utf8.RuneCountInString(fl.Field().String()) >= Policy.MinLength
+}
+
+func validatePasswordClasses(fl validator.FieldLevel) bool {
+	var lower, upper, digit, symbol int
+	for _, r := range fl.Field().String() {
+		switch {
+		case unicode.IsUpper(r):
+			upper = 1
+		// Letters from scripts without case (like Arabic) count as lowercase
+		case unicode.IsLetter(r):
+			lower = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower+upper+digit+symbol >= Policy.MinCharacterClasses
+}
+
+// Looks for UserName and Email fields next to the password in the same struct,
+// the password can't contain either of them
+func validatePasswordPersonal(fl validator.FieldLevel) bool {
+	if !Policy.RejectPersonalInfo {
+		return true
+	}
+
+	password := strings.ToLower(fl.Field().String())
+
+	parent := fl.Parent()
+	if parent.Kind() == reflect.Ptr {
+		parent = parent.Elem()
+	}
+	if parent.Kind() != reflect.Struct {
+		return true
+	}
+
+	for _, name := range []string{"UserName", "Email"} {
+		field := parent.FieldByName(name)
+		if !field.IsValid() || field.Kind() != reflect.String {
+			continue
+		}
+
+		value := strings.ToLower(field.String())
+		if name == "Email" {
+			value, _, _ = strings.Cut(value, "@")
+		}
+
+		// Very short names would reject too many passwords
+		if utf8.RuneCountInString(value) >= 3 && strings.Contains(password, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validatePasswordCommon(fl validator.FieldLevel) bool {
+	_, found := Policy.Blocklist[strings.ToLower(fl.Field().String())]
+	return !found
+}
@@ -3,6 +3,8 @@ package validation
 import (
 	"Sadeem-RestAPI/internal/translation"
 	"errors"
+	"regexp"
+	"strconv"
 
 	"github.com/go-playground/validator"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
@@ -20,13 +22,23 @@ type CustomValidator struct {
 	V *validator.Validate
 }
 
+// Creates a validator with our custom tags registered
+func New() *CustomValidator {
+	v := validator.New()
+	registerPasswordTags(v)
+	v.RegisterValidation("slug", validateSlug)
+
+	return &CustomValidator{V: v}
+}
+
 func (cv *CustomValidator) Validate(i interface{}, errLang string) ([]ApiError, error) {
 	if err := cv.V.Struct(i); err != nil {
 		var ve validator.ValidationErrors
 		if errors.As(err, &ve) {
 			out := make([]ApiError, len(ve))
 			for i, fe := range ve {
-				out[i] = ApiError{msgForField(fe.Field()), msgForTag(fe.Tag(), errLang)}
+				// ActualTag so aliases like "password" report the rule that failed
+				out[i] = ApiError{msgForField(fe.Field()), msgForTag(fe.ActualTag(), errLang)}
 			}
 			return out, err
 		}
@@ -36,6 +48,19 @@ func (cv *CustomValidator) Validate(i interface{}, errLang string) ([]ApiError,
 	return nil, nil
 }
 
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Slugs end up in URLs so they're kept to lowercase letters, digits and single dashes,
+// they can't be just digits since those are taken to be IDs
+func validateSlug(fl validator.FieldLevel) bool {
+	slug := fl.Field().String()
+	if _, err := strconv.Atoi(slug); err == nil {
+		return false
+	}
+
+	return slugPattern.MatchString(slug)
+}
+
 func msgForField(field string) string {
 	switch field {
 
@@ -47,6 +72,12 @@ func msgForField(field string) string {
 		return "name"
 	case "UserName":
 		return "userName"
+	case "NewPassword":
+		return "newPassword"
+	case "CurrentPassword":
+		return "currentPassword"
+	case "Slug":
+		return "slug"
 	default:
 		return field
 	}
@@ -70,6 +101,43 @@ func msgForTag(tag, lang string) string {
 				Other: "Invalid Email address",
 			},
 		})
+	case "password_length":
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "PasswordTooShort",
+				Other: "Password must be at least {{.MinLength}} characters long",
+			},
+			TemplateData: map[string]int{"MinLength": Policy.MinLength},
+		})
+	case "password_classes":
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "PasswordCharacterClasses",
+				Other: "Password must contain at least {{.MinClasses}} of the following: lowercase letters, uppercase letters, digits and symbols",
+			},
+			TemplateData: map[string]int{"MinClasses": Policy.MinCharacterClasses},
+		})
+	case "password_personal":
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "PasswordPersonalInfo",
+				Other: "Password must not contain your username or email",
+			},
+		})
+	case "password_common":
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "PasswordTooCommon",
+				Other: "This password is too common, please choose another one",
+			},
+		})
+	case "slug":
+		msg = localizer.MustLocalize(&i18n.LocalizeConfig{
+			DefaultMessage: &i18n.Message{
+				ID:    "InvalidSlug",
+				Other: "Slugs can only contain lowercase letters, digits and dashes between them, and can't be only digits",
+			},
+		})
 	default:
 		msg = tag
 	}